@@ -0,0 +1,317 @@
+// Copyright (c) 2017 Zededa, Inc.
+// All rights reserved.
+
+// Package apiserver hosts zedmanager's opt-in gRPC ApplicationService
+// (applicationservice.proto), with a grpc-gateway REST reverse proxy in
+// front of it. It gives operators and local tooling a first-class way to
+// drive AppInstances on a node without synthesizing files under /var/tmp
+// or running a full zedagent, and makes zedmanager testable end-to-end
+// from Go tests.
+//
+// RPCs are translated into the same pubsub actions zedagent already
+// drives zedmanager with: Install/Update/Start/Stop publish an
+// AppInstanceConfig under this server's own agent name, Uninstall
+// unpublishes it, Rollback publishes an AppInstanceCommand, and
+// List/Get/Watch read back
+// AppInstanceStatus. zedmanager.Run subscribes to this server's agent
+// name the same way it subscribes to zedagent's, so the API server is
+// just one more client of the pipeline, not a parallel code path.
+package apiserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/zededa/go-provision/cmd/zedmanager/apiserver/pb"
+	"github.com/zededa/go-provision/pubsub"
+	"github.com/zededa/go-provision/types"
+)
+
+// Config controls how Serve listens. Set Addr for a TCP listener guarded
+// by mTLS using the device's own identity certificate, or SocketPath for a
+// unix domain socket for same-host tooling (filesystem permissions are the
+// access control there, so no TLS is required).
+type Config struct {
+	Addr       string
+	SocketPath string
+
+	// CertificateDir holds server.pem/server-key.pem and the
+	// root-certificate.pem CA bundle trusted for client certs, the same
+	// layout as zedmanager's certificateDirname. Required when Addr is set.
+	CertificateDir string
+}
+
+// Server implements pb.ApplicationServiceServer. Construct it with New and
+// register it with a *grpc.Server via pb.RegisterApplicationServiceServer,
+// or just call Serve.
+type Server struct {
+	pb.UnimplementedApplicationServiceServer
+
+	pubConfig  *pubsub.Publication
+	pubCommand *pubsub.Publication
+	getStatus  func(uuid string) *types.AppInstanceStatus
+	listStatus func() []*types.AppInstanceStatus
+
+	mu       sync.Mutex
+	watchers map[chan *types.AppInstanceStatus]struct{}
+}
+
+// New returns a Server that publishes AppInstanceConfig and
+// AppInstanceCommand under agentName -- so it shows up as just another
+// producer alongside zedagent -- and reads status back through getStatus/
+// listStatus, which the caller backs with zedmanager's own
+// AppInstanceStatus publication (see lookupAppInstanceStatus).
+func New(agentName string, getStatus func(uuid string) *types.AppInstanceStatus,
+	listStatus func() []*types.AppInstanceStatus) (*Server, error) {
+
+	pubConfig, err := pubsub.Publish(agentName, types.AppInstanceConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("apiserver: publishing AppInstanceConfig: %w", err)
+	}
+	pubCommand, err := pubsub.Publish(agentName, types.AppInstanceCommand{})
+	if err != nil {
+		return nil, fmt.Errorf("apiserver: publishing AppInstanceCommand: %w", err)
+	}
+	return &Server{
+		pubConfig:  pubConfig,
+		pubCommand: pubCommand,
+		getStatus:  getStatus,
+		listStatus: listStatus,
+		watchers:   make(map[chan *types.AppInstanceStatus]struct{}),
+	}, nil
+}
+
+// Notify fans status out to every open Watch stream. The caller invokes
+// this right after its own guaranteedUpdateAppInstanceStatus commits a
+// change, so Watch only ever sees updates that won that race.
+func (s *Server) Notify(status *types.AppInstanceStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.watchers {
+		select {
+		case ch <- status:
+		default:
+			// Slow watcher; drop rather than block the publisher.
+		}
+	}
+}
+
+// List implements pb.ApplicationServiceServer.
+func (s *Server) List(ctx context.Context, req *pb.ListAppInstancesRequest) (*pb.ListAppInstancesResponse, error) {
+	var resp pb.ListAppInstancesResponse
+	for _, st := range s.listStatus() {
+		resp.Instances = append(resp.Instances, toProto(st))
+	}
+	return &resp, nil
+}
+
+// Get implements pb.ApplicationServiceServer.
+func (s *Server) Get(ctx context.Context, req *pb.GetAppInstanceRequest) (*pb.AppInstanceStatus, error) {
+	st := s.getStatus(req.Uuid)
+	if st == nil {
+		return nil, status.Errorf(codes.NotFound, "app instance %s not found", req.Uuid)
+	}
+	return toProto(st), nil
+}
+
+// Install implements pb.ApplicationServiceServer.
+func (s *Server) Install(ctx context.Context, req *pb.InstallAppInstanceRequest) (*pb.AppInstanceStatus, error) {
+	return s.publishConfig(req.Config)
+}
+
+// Update implements pb.ApplicationServiceServer.
+func (s *Server) Update(ctx context.Context, req *pb.UpdateAppInstanceRequest) (*pb.AppInstanceStatus, error) {
+	return s.publishConfig(req.Config)
+}
+
+func (s *Server) publishConfig(in *pb.AppInstanceConfig) (*pb.AppInstanceStatus, error) {
+	config, err := fromProto(in)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	key := config.UUIDandVersion.UUID.String()
+	s.pubConfig.Publish(key, config)
+	return &pb.AppInstanceStatus{Uuid: key, Version: config.UUIDandVersion.Version}, nil
+}
+
+// Uninstall implements pb.ApplicationServiceServer by unpublishing the
+// instance's AppInstanceConfig under this server's agent name; zedmanager's
+// handleDelete then tears the instance down.
+func (s *Server) Uninstall(ctx context.Context, req *pb.UninstallAppInstanceRequest) (*pb.AppInstanceStatus, error) {
+	s.pubConfig.Unpublish(req.Uuid)
+	return &pb.AppInstanceStatus{Uuid: req.Uuid}, nil
+}
+
+// Start implements pb.ApplicationServiceServer.
+func (s *Server) Start(ctx context.Context, req *pb.StartAppInstanceRequest) (*pb.AppInstanceStatus, error) {
+	return s.setActivate(req.Uuid, true)
+}
+
+// Stop implements pb.ApplicationServiceServer.
+func (s *Server) Stop(ctx context.Context, req *pb.StopAppInstanceRequest) (*pb.AppInstanceStatus, error) {
+	return s.setActivate(req.Uuid, false)
+}
+
+func (s *Server) setActivate(uuidStr string, activate bool) (*pb.AppInstanceStatus, error) {
+	st := s.getStatus(uuidStr)
+	if st == nil {
+		return nil, status.Errorf(codes.NotFound, "app instance %s not found", uuidStr)
+	}
+	config := types.AppInstanceConfig{
+		UUIDandVersion: st.UUIDandVersion,
+		DisplayName:    st.DisplayName,
+		Activate:       activate,
+	}
+	s.pubConfig.Publish(uuidStr, config)
+	return toProto(st), nil
+}
+
+// Rollback implements pb.ApplicationServiceServer by publishing an
+// AppInstanceCommand; RollbackAppInstance in zedmanager.go does the actual
+// work of flipping the version pointer, since rollback doesn't fit the
+// declarative "this is the desired state" model AppInstanceConfig expresses.
+func (s *Server) Rollback(ctx context.Context, req *pb.RollbackAppInstanceRequest) (*pb.AppInstanceStatus, error) {
+	cmd := types.AppInstanceCommand{
+		UUIDandVersion: types.UUIDandVersion{UUID: mustParseUUID(req.Uuid)},
+		Op:             types.AppInstanceOpRollback,
+	}
+	s.pubCommand.Publish(req.Uuid, cmd)
+	return &pb.AppInstanceStatus{Uuid: req.Uuid}, nil
+}
+
+// Watch implements pb.ApplicationServiceServer, streaming the status
+// updates Notify delivers until the client disconnects. Notify drops an
+// update for this stream while its 16-entry buffer is full.
+func (s *Server) Watch(req *pb.WatchAppInstancesRequest, stream pb.ApplicationService_WatchServer) error {
+	ch := make(chan *types.AppInstanceStatus, 16)
+	s.mu.Lock()
+	s.watchers[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, ch)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case st := <-ch:
+			if err := stream.Send(toProto(st)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func toProto(st *types.AppInstanceStatus) *pb.AppInstanceStatus {
+	return &pb.AppInstanceStatus{
+		Uuid:        st.UUIDandVersion.UUID.String(),
+		Version:     st.UUIDandVersion.Version,
+		DisplayName: st.DisplayName,
+	}
+}
+
+func fromProto(in *pb.AppInstanceConfig) (types.AppInstanceConfig, error) {
+	if in == nil {
+		return types.AppInstanceConfig{}, fmt.Errorf("apiserver: missing config")
+	}
+	id, err := uuid.FromString(in.Uuid)
+	if err != nil {
+		return types.AppInstanceConfig{}, fmt.Errorf("apiserver: invalid uuid %q: %w", in.Uuid, err)
+	}
+	return types.AppInstanceConfig{
+		UUIDandVersion: types.UUIDandVersion{UUID: id, Version: in.Version},
+		DisplayName:    in.DisplayName,
+		Activate:       in.Activate,
+	}, nil
+}
+
+func mustParseUUID(s string) uuid.UUID {
+	id, err := uuid.FromString(s)
+	if err != nil {
+		return uuid.UUID{}
+	}
+	return id
+}
+
+// Serve starts srv on cfg's listener and blocks until the listener fails
+// or is closed. Run it in its own goroutine from zedmanager.Run when the
+// API server is enabled.
+func Serve(cfg Config, srv *Server) error {
+	opts, err := serverOptions(cfg)
+	if err != nil {
+		return err
+	}
+	grpcServer := grpc.NewServer(opts...)
+	pb.RegisterApplicationServiceServer(grpcServer, srv)
+
+	lis, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+
+	return grpcServer.Serve(lis)
+}
+
+func listen(cfg Config) (net.Listener, error) {
+	if cfg.SocketPath != "" {
+		if err := os.Remove(cfg.SocketPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("apiserver: removing stale socket %s: %w", cfg.SocketPath, err)
+		}
+		return net.Listen("unix", cfg.SocketPath)
+	}
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("apiserver: Config must set Addr or SocketPath")
+	}
+	return net.Listen("tcp", cfg.Addr)
+}
+
+func serverOptions(cfg Config) ([]grpc.ServerOption, error) {
+	if cfg.SocketPath != "" {
+		// Unix socket: filesystem permissions are the access control, so
+		// no TLS is required for same-host tooling.
+		return nil, nil
+	}
+	creds, err := loadServerTLS(cfg.CertificateDir)
+	if err != nil {
+		return nil, err
+	}
+	return []grpc.ServerOption{grpc.Creds(creds)}, nil
+}
+
+func loadServerTLS(dir string) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("apiserver: loading server certificate: %w", err)
+	}
+	caBytes, err := os.ReadFile(filepath.Join(dir, "root-certificate.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("apiserver: loading CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("apiserver: no certificates found in %s/root-certificate.pem", dir)
+	}
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}), nil
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2017 Zededa, Inc.
+// All rights reserved.
+
+// Package depgraph replaces the hand-rolled two-flag restart handshake
+// zedmanager used to order bring-up of its downstream agents (config and
+// verifier both restarted, then identitymgr, then zedrouter, then
+// domainmgr) with a small dependency-graph supervisor, in the spirit of
+// how syncthing composes services with suture. Each agent is a Node with
+// a list of prerequisite Nodes; Graph fires the node's restart action
+// exactly once, as soon as every prerequisite has reported restarted, and
+// tracks per-node health so a stale or persistently erroring node can be
+// re-signaled with backoff instead of silently wedging the cascade.
+package depgraph
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NodeID names one stage of the restart cascade, e.g. "identitymgr".
+type NodeID string
+
+// Node declares one stage: DependsOn lists the NodeIDs that must all
+// report restarted before this node's restart action fires. Restartable
+// marks whether it makes sense to re-fire that action on a health
+// regression (config/verifier are upstream data sources with no restart
+// action of their own, so they leave this false).
+type Node struct {
+	ID          NodeID
+	DependsOn   []NodeID
+	Restartable bool
+}
+
+// EventKind categorizes an Event emitted by Graph.
+type EventKind int
+
+// Event kinds.
+const (
+	EventRestartSignaled EventKind = iota
+	EventStale
+	EventError
+	EventRecovered
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventRestartSignaled:
+		return "restart-signaled"
+	case EventStale:
+		return "stale"
+	case EventError:
+		return "error"
+	case EventRecovered:
+		return "recovered"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a structured notification about one node's state change,
+// suitable for logging or for surfacing on a status publication.
+type Event struct {
+	Node NodeID
+	Kind EventKind
+	Err  error
+}
+
+func (e Event) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s (%s)", e.Node, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Node, e.Kind)
+}
+
+// Status is the externally visible state of one node, for exposing the
+// graph on a status publication so operators can see which stage of the
+// restart cascade is blocking bring-up.
+type Status struct {
+	Restarted bool
+	Healthy   bool
+	LastErr   error
+	UpdatedAt time.Time
+}
+
+// Options bounds Graph's staleness detection and restart backoff.
+type Options struct {
+	// StaleAfter is how long a node may go without a health report before
+	// CheckStale considers it stale. Zero disables staleness detection.
+	StaleAfter time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultOptions is a reasonable staleness window with capped exponential
+// backoff between re-signals.
+var DefaultOptions = Options{
+	StaleAfter: 2 * time.Minute,
+	MinBackoff: 5 * time.Second,
+	MaxBackoff: 5 * time.Minute,
+}
+
+type nodeState struct {
+	node      Node
+	restarted bool
+	signaled  bool
+	healthy   bool
+	lastErr   error
+	updatedAt time.Time
+	retries   int
+	nextRetry time.Time
+}
+
+// Graph tracks the restart cascade and fires onSignal(id) exactly once per
+// node, as soon as all of that node's prerequisites have reported
+// restarted via MarkRestarted.
+type Graph struct {
+	opts     Options
+	onSignal func(NodeID)
+	onEvent  func(Event)
+
+	mu    sync.Mutex
+	nodes map[NodeID]*nodeState
+}
+
+// NewGraph builds a Graph over nodes. onSignal is called exactly once per
+// node when its dependencies are satisfied (or immediately, for a node
+// with no dependencies, the first time it is observed); onEvent reports
+// staleness/error/recovery transitions. A zero Options is replaced with
+// DefaultOptions.
+func NewGraph(nodes []Node, onSignal func(NodeID), onEvent func(Event), opts Options) *Graph {
+	if opts == (Options{}) {
+		opts = DefaultOptions
+	}
+	g := &Graph{
+		opts:     opts,
+		onSignal: onSignal,
+		onEvent:  onEvent,
+		nodes:    make(map[NodeID]*nodeState, len(nodes)),
+	}
+	for _, n := range nodes {
+		g.nodes[n.ID] = &nodeState{node: n}
+	}
+	return g
+}
+
+func (g *Graph) emit(ev Event) {
+	if g.onEvent != nil {
+		g.onEvent(ev)
+	}
+}
+
+func (g *Graph) ready(id NodeID) bool {
+	n := g.nodes[id]
+	if n == nil || n.restarted {
+		return false
+	}
+	for _, dep := range n.node.DependsOn {
+		d := g.nodes[dep]
+		if d == nil || !d.restarted {
+			return false
+		}
+	}
+	return true
+}
+
+// MarkRestarted records that id has finished its own restart handshake
+// (e.g. its RestartHandler callback fired with done=true) and, for every
+// node whose prerequisites are now all satisfied, fires onSignal exactly
+// once.
+func (g *Graph) MarkRestarted(id NodeID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := g.nodes[id]
+	if n == nil {
+		return
+	}
+	n.restarted = true
+	n.healthy = true
+	n.updatedAt = time.Now()
+
+	// A node becoming restarted can unblock any number of dependents, not
+	// just itself, so re-evaluate every node rather than just id.
+	for nid, state := range g.nodes {
+		if !state.signaled && g.ready(nid) {
+			state.signaled = true
+			g.emit(Event{Node: nid, Kind: EventRestartSignaled})
+			if g.onSignal != nil {
+				g.onSignal(nid)
+			}
+		}
+	}
+}
+
+// ReportHealth records a liveness observation for id, e.g. from polling
+// its status directory. A non-nil err marks it unhealthy; if id is
+// Restartable, ReportHealth re-fires onSignal once enough backoff has
+// elapsed since the last attempt.
+func (g *Graph) ReportHealth(id NodeID, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := g.nodes[id]
+	if n == nil {
+		return
+	}
+	n.updatedAt = time.Now()
+
+	wasHealthy := n.healthy
+	if err == nil {
+		n.healthy = true
+		n.lastErr = nil
+		if !wasHealthy {
+			g.emit(Event{Node: id, Kind: EventRecovered})
+		}
+		return
+	}
+
+	n.healthy = false
+	n.lastErr = err
+	g.emit(Event{Node: id, Kind: EventError, Err: err})
+	g.maybeRetry(id, n)
+}
+
+// CheckStale scans every node for one that hasn't reported health within
+// Options.StaleAfter, emits an EventStale for each, and re-signals
+// Restartable ones subject to backoff. Call it periodically, e.g. from a
+// time.Ticker in the caller's main loop.
+func (g *Graph) CheckStale(now time.Time) {
+	if g.opts.StaleAfter <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for id, n := range g.nodes {
+		if n.updatedAt.IsZero() || now.Sub(n.updatedAt) < g.opts.StaleAfter {
+			continue
+		}
+		n.healthy = false
+		g.emit(Event{Node: id, Kind: EventStale,
+			Err: fmt.Errorf("no health report for %s", now.Sub(n.updatedAt))})
+		g.maybeRetry(id, n)
+	}
+}
+
+// maybeRetry re-fires onSignal for a Restartable node whose backoff has
+// elapsed. Callers must hold g.mu.
+func (g *Graph) maybeRetry(id NodeID, n *nodeState) {
+	if !n.node.Restartable || !n.restarted {
+		return
+	}
+	now := time.Now()
+	if now.Before(n.nextRetry) {
+		return
+	}
+	n.retries++
+	n.nextRetry = now.Add(backoff(g.opts.MinBackoff, g.opts.MaxBackoff, n.retries))
+	g.emit(Event{Node: id, Kind: EventRestartSignaled})
+	if g.onSignal != nil {
+		g.onSignal(id)
+	}
+}
+
+func backoff(min, max time.Duration, attempt int) time.Duration {
+	if min <= 0 {
+		min = time.Second
+	}
+	d := min << uint(attempt-1)
+	if d <= 0 || (max > 0 && d > max) {
+		d = max
+	}
+	return d
+}
+
+// Snapshot returns the current Status of every node, for exposing the
+// graph's progress on a status publication.
+func (g *Graph) Snapshot() map[NodeID]Status {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	out := make(map[NodeID]Status, len(g.nodes))
+	for id, n := range g.nodes {
+		out[id] = Status{
+			Restarted: n.restarted,
+			Healthy:   n.healthy,
+			LastErr:   n.lastErr,
+			UpdatedAt: n.updatedAt,
+		}
+	}
+	return out
+}
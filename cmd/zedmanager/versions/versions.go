@@ -0,0 +1,149 @@
+// Copyright (c) 2017 Zededa, Inc.
+// All rights reserved.
+
+// Package versions keeps a bounded history of AppInstance configuration
+// versions per UUID, so zedmanager can stage a new version alongside the
+// one currently running and flip back to the last-known-good version on
+// demand, instead of overwriting a single slot in place and having no way
+// back if the new version doesn't come up healthy.
+package versions
+
+import "sync"
+
+// DefaultHistoryLimit bounds how many prior versions a Store retains per
+// UUID before the oldest is garbage collected.
+const DefaultHistoryLimit = 5
+
+// entry is the per-UUID version ledger: current is the active version,
+// history holds prior versions newest-first, bounded to the Store's limit.
+type entry struct {
+	current string
+	history []string
+	payload map[string]interface{}
+}
+
+// Store tracks, for each AppInstance UUID, which version is active and
+// which earlier versions are still available to roll back to, along with
+// an opaque payload per version (typically its types.AppInstanceConfig)
+// so a rollback can re-drive the downstream agents without needing the
+// caller to have kept its own copy around.
+type Store struct {
+	historyLimit int
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// NewStore returns a Store that retains at most historyLimit prior
+// versions per UUID. A non-positive historyLimit is replaced with
+// DefaultHistoryLimit.
+func NewStore(historyLimit int) *Store {
+	if historyLimit <= 0 {
+		historyLimit = DefaultHistoryLimit
+	}
+	return &Store{
+		historyLimit: historyLimit,
+		entries:      make(map[string]*entry),
+	}
+}
+
+func (s *Store) entryFor(uuid string) *entry {
+	e := s.entries[uuid]
+	if e == nil {
+		e = &entry{payload: make(map[string]interface{})}
+		s.entries[uuid] = e
+	}
+	return e
+}
+
+// Stage records version as a candidate for uuid, remembering payload so a
+// later Rollback can hand it back. It does not change uuid's active
+// version; call Activate once the staged version is confirmed healthy.
+func (s *Store) Stage(uuid, version string, payload interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entryFor(uuid).payload[version] = payload
+}
+
+// Activate makes version the active version for uuid, pushing the
+// previously active version onto the front of the history and returning
+// it (the empty string if uuid had no prior version) so the caller knows
+// what to tear down. History beyond the Store's limit is garbage
+// collected, dropping the oldest version's payload first.
+func (s *Store) Activate(uuid, version string) (previous string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entryFor(uuid)
+	previous = e.current
+	if previous != "" && previous != version {
+		e.history = append([]string{previous}, e.history...)
+	}
+	e.current = version
+	for len(e.history) > s.historyLimit {
+		drop := e.history[len(e.history)-1]
+		e.history = e.history[:len(e.history)-1]
+		if drop != e.current {
+			delete(e.payload, drop)
+		}
+	}
+	return previous
+}
+
+// Current returns uuid's active version, if any.
+func (s *Store) Current(uuid string) (version string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[uuid]
+	if e == nil || e.current == "" {
+		return "", false
+	}
+	return e.current, true
+}
+
+// Payload returns the payload Stage recorded for uuid's version, if any,
+// without disturbing uuid's active version or history the way Rollback
+// does. activateVersion in zedmanager uses this to recover the config of
+// the version it is tearing down.
+func (s *Store) Payload(uuid, version string) (payload interface{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[uuid]
+	if e == nil {
+		return nil, false
+	}
+	payload, ok = e.payload[version]
+	return payload, ok
+}
+
+// History returns uuid's prior versions, most recently active first.
+func (s *Store) History(uuid string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[uuid]
+	if e == nil {
+		return nil
+	}
+	out := make([]string, len(e.history))
+	copy(out, e.history)
+	return out
+}
+
+// Rollback activates uuid's most recent history entry -- the last-known-
+// good version before the current one -- and returns its version and the
+// payload Stage recorded for it. It reports ok=false if uuid has no
+// earlier version to roll back to.
+func (s *Store) Rollback(uuid string) (version string, payload interface{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[uuid]
+	if e == nil || len(e.history) == 0 {
+		return "", nil, false
+	}
+	target := e.history[0]
+	e.history = e.history[1:]
+	if e.current != "" {
+		e.history = append([]string{e.current}, e.history...)
+	}
+	e.current = target
+	return target, e.payload[target], true
+}
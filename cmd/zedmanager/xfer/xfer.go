@@ -0,0 +1,268 @@
+// Copyright (c) 2017 Zededa, Inc.
+// All rights reserved.
+
+// Package xfer coordinates image transfers (download + verify) driven by
+// zedmanager, modeled on Docker's distribution transfer manager. Without
+// it, zedmanager published one downloader/verifier config per storage
+// entry with no coordination, so N AppInstances referencing the same
+// ImageSha256/DownloadURL fanned out N redundant downloads. A Manager
+// keeps a single in-flight Job per content digest and lets every caller
+// that references the same digest attach as a watcher of that job instead
+// of starting its own.
+package xfer
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// State is the lifecycle state of a Job.
+type State int
+
+// Job lifecycle states.
+const (
+	StatePending State = iota
+	StateDownloading
+	StateVerifying
+	StateDone
+	StateFailed
+)
+
+// Status is a point-in-time snapshot of a Job, published to every watcher.
+type Status struct {
+	Key     string
+	State   State
+	Attempt int
+	Err     error
+}
+
+// XferFunc does the actual work of driving a transfer (publishing
+// downloader/verifier config and waiting for their status) for key. It
+// blocks until the transfer reaches a terminal state, invoking progress
+// with each intermediate Status.
+type XferFunc func(key string, progress func(Status)) error
+
+// watcher is one caller attached to a job; statusCh carries Status updates
+// until the watcher cancels or the job finishes. An update is dropped for a
+// watcher whose channel buffer is full.
+type watcher struct {
+	id       string
+	statusCh chan Status
+}
+
+// job is the in-flight (or completed) state for one content digest.
+type job struct {
+	key       string
+	watchers  map[string]*watcher
+	status    Status
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// abort closes j.done, waking up a run() blocked in its retry backoff. It is
+// safe to call from both detach (last watcher gone) and run itself (normal
+// completion), and safe to call more than once.
+func (j *job) abort() {
+	j.closeOnce.Do(func() { close(j.done) })
+}
+
+// Config bounds the Manager's worker pool and retry behavior.
+type Config struct {
+	MaxConcurrentDownloads     int
+	MaxConcurrentVerifications int
+	MaxRetries                 int
+	MinBackoff                 time.Duration
+	MaxBackoff                 time.Duration
+}
+
+// DefaultConfig matches what a handful of AppInstances arriving at once
+// should be allowed to stampede the network with.
+var DefaultConfig = Config{
+	MaxConcurrentDownloads:     3,
+	MaxConcurrentVerifications: 2,
+	MaxRetries:                 5,
+	MinBackoff:                 2 * time.Second,
+	MaxBackoff:                 2 * time.Minute,
+}
+
+// Manager is the keyed job registry: Transfer(key, ...) either starts a new
+// job for key or attaches the caller as an additional watcher of an
+// in-flight one.
+type Manager struct {
+	cfg Config
+
+	mu   sync.Mutex
+	jobs map[string]*job
+
+	downloadSem chan struct{}
+	verifySem   chan struct{}
+}
+
+// NewManager returns a Manager that enforces cfg's concurrency and retry
+// limits. A zero Config is replaced with DefaultConfig.
+func NewManager(cfg Config) *Manager {
+	if cfg == (Config{}) {
+		cfg = DefaultConfig
+	}
+	return &Manager{
+		cfg:         cfg,
+		jobs:        make(map[string]*job),
+		downloadSem: make(chan struct{}, cfg.MaxConcurrentDownloads),
+		verifySem:   make(chan struct{}, cfg.MaxConcurrentVerifications),
+	}
+}
+
+// Transfer registers watcherID as interested in key (e.g. an AppInstance
+// UUID watching an ImageSha256), starting xferFunc in the background if no
+// job for key is already in flight, and returns a channel of Status updates
+// for this watcher. Cancel must be called exactly once to detach. When the
+// last watcher cancels, the job is aborted and dropped from the registry
+// (see detach); nothing is unpublished here.
+func (m *Manager) Transfer(key string, watcherID string, xferFunc XferFunc) (<-chan Status, func()) {
+	m.mu.Lock()
+	j, exists := m.jobs[key]
+	if !exists {
+		j = &job{
+			key:      key,
+			watchers: make(map[string]*watcher),
+			status:   Status{Key: key, State: StatePending},
+			done:     make(chan struct{}),
+		}
+		m.jobs[key] = j
+	}
+	w := &watcher{id: watcherID, statusCh: make(chan Status, 8)}
+	j.watchers[watcherID] = w
+	// A late joiner should immediately see the current state rather than
+	// wait for the next transition.
+	w.statusCh <- j.status
+	m.mu.Unlock()
+
+	if !exists {
+		go m.run(j, xferFunc)
+	}
+
+	cancel := func() { m.detach(key, watcherID) }
+	return w.statusCh, cancel
+}
+
+// Cancel detaches watcherID from key's job, same as the cancel func Transfer
+// returns. It exists for callers that need to detach a watcher from a key
+// they didn't call Transfer for themselves -- e.g. tearing down a previous
+// AppInstance version's storage jobs on behalf of a UUID whose per-item
+// cancel closures were only ever retained inside the original transfer's
+// goroutine.
+func (m *Manager) Cancel(key string, watcherID string) {
+	m.detach(key, watcherID)
+}
+
+// detach removes watcherID from key's job and closes its channel; once the
+// last watcher leaves, the job is aborted, which ends a retry backoff wait
+// in run, and removed from the registry. An xferFunc call already in
+// progress is not interrupted, and the downloader/verifier config it
+// published is not unpublished.
+func (m *Manager) detach(key string, watcherID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[key]
+	if !ok {
+		return
+	}
+	if w, ok := j.watchers[watcherID]; ok {
+		close(w.statusCh)
+		delete(j.watchers, watcherID)
+	}
+	if len(j.watchers) == 0 {
+		j.abort()
+		delete(m.jobs, key)
+	}
+}
+
+// fanOut publishes status to every current watcher of j and remembers it
+// as j's last known state for late joiners.
+func (m *Manager) fanOut(j *job, status Status) {
+	m.mu.Lock()
+	j.status = status
+	watchers := make([]*watcher, 0, len(j.watchers))
+	for _, w := range j.watchers {
+		watchers = append(watchers, w)
+	}
+	m.mu.Unlock()
+
+	for _, w := range watchers {
+		select {
+		case w.statusCh <- status:
+		default:
+			// Slow watcher; drop rather than block the transfer.
+		}
+	}
+}
+
+// run drives xferFunc for job j, retrying transient failures with
+// exponential backoff and jitter. It holds a downloadSem slot for the whole
+// run, which bounds concurrent jobs; verifications are bounded separately
+// by AcquireVerifySlot, which xferFunc calls.
+func (m *Manager) run(j *job, xferFunc XferFunc) {
+	defer j.abort()
+
+	m.downloadSem <- struct{}{}
+	defer func() { <-m.downloadSem }()
+
+	attempt := 0
+	for {
+		attempt++
+		m.fanOut(j, Status{Key: j.key, State: StateDownloading, Attempt: attempt})
+
+		err := xferFunc(j.key, func(s Status) {
+			s.Attempt = attempt
+			m.fanOut(j, s)
+		})
+		if err == nil {
+			m.fanOut(j, Status{Key: j.key, State: StateDone, Attempt: attempt})
+			return
+		}
+
+		if m.cfg.MaxRetries > 0 && attempt >= m.cfg.MaxRetries {
+			m.fanOut(j, Status{Key: j.key, State: StateFailed, Attempt: attempt,
+				Err: fmt.Errorf("giving up after %d attempts: %w", attempt, err)})
+			return
+		}
+
+		backoff := jitteredBackoff(m.cfg.MinBackoff, m.cfg.MaxBackoff, attempt)
+		m.fanOut(j, Status{Key: j.key, State: StatePending, Attempt: attempt, Err: err})
+		select {
+		case <-time.After(backoff):
+		case <-j.abortCh():
+			return
+		}
+	}
+}
+
+// abortCh lets run() notice a job with no watchers left mid-backoff without
+// threading a context through every XferFunc implementation.
+func (j *job) abortCh() <-chan struct{} {
+	return j.done
+}
+
+func jitteredBackoff(min, max time.Duration, attempt int) time.Duration {
+	if min <= 0 {
+		min = time.Second
+	}
+	d := min << uint(attempt-1)
+	if d <= 0 || (max > 0 && d > max) {
+		d = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(d) / 2))
+	return d/2 + jitter
+}
+
+// AcquireVerifySlot blocks until a verification worker slot is free and
+// returns a release function. XferFunc implementations call this around
+// the verifier phase so downloads and verifications are bounded
+// independently (downloading is typically network-bound, verifying is
+// typically CPU/disk-bound).
+func (m *Manager) AcquireVerifySlot() func() {
+	m.verifySem <- struct{}{}
+	return func() { <-m.verifySem }
+}
@@ -6,146 +6,22 @@
 package zedrouter
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/zededa/go-provision/cmd/zedrouter/lispconf"
+	"github.com/zededa/go-provision/cmd/zedrouter/procsup"
+	"github.com/zededa/go-provision/pkg/logger"
 	"github.com/zededa/go-provision/types"
 	"github.com/zededa/go-provision/wrap"
-	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
-	"strconv"
+	"os/exec"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Template per map server. Pass in (dns-name, authentication-key)
-// Use this for the Mgmt IID
-const lispMStemplateMgmt = `
-lisp map-resolver {
-	dns-name = %s
-}
-lisp map-server {
-    dns-name = %s
-    authentication-key = %s
-    want-map-notify = yes
-}
-`
-
-// Template per map server. Pass in (IID, dns-name, authentication-key)
-const lispMStemplate = `
-lisp map-server {
-    ms-name = ms-%d
-    dns-name = %s
-    authentication-key = %s
-    want-map-notify = yes
-}
-`
-
-// Need to fill in IID in 1 place
-const lispIIDtemplate = `
-lisp map-cache {
-    prefix {
-        instance-id = %d
-        eid-prefix = fd00::/8
-		send-map-request = yes
-    }
-}
-`
-
-// Need to fill in (signature, additional, olIfname, IID)
-// Use this for the Mgmt IID/EID
-const lispEIDtemplateMgmt = `
-lisp json {
-    json-name = signature
-    json-string = { "signature" : "%s" }
-}
-
-lisp json {
-    json-name = additional-info
-    json-string = %s
-}
-
-lisp interface {
-    interface-name = overlay-mgmt
-    device = %s
-    instance-id = %d
-}
-`
-
-// Need to pass in (IID, EID, rlocs), where rlocs is a string with
-// sets of uplink info with:
-// rloc {
-//        interface = %s
-// }
-// rloc {
-//        address = %s
-// }
-const lispDBtemplateMgmt = `
-lisp database-mapping {
-    prefix {
-        instance-id = %d
-        eid-prefix = %s/128
-        signature-eid = yes
-    }
-    rloc {
-        json-name = signature
-        priority = 255
-    }
-    rloc {
-        json-name = additional-info
-        priority = 255
-    }
-%s
-}
-`
-
-// Need to fill in (tag, signature, tag, additional, olifname, olifname, IID)
-// Use this for the application EIDs
-const lispEIDtemplate = `
-lisp json {
-    json-name = signature-%s
-    json-string = { "signature" : "%s" }
-}
-
-lisp json {
-    json-name = additional-info-%s
-    json-string = %s
-}
-
-lisp interface {
-    interface-name = overlay-%s
-    device = %s
-    instance-id = %d
-}
-`
-
-// Need to fill in (IID, EID, IID, tag, tag, rlocs) where
-// rlocs is a string with sets of uplink info with:
-// rloc {
-//        interface = %s
-// }
-// rloc {
-//        address = %s
-//        priority = %d
-// }
-const lispDBtemplate = `
-lisp database-mapping {
-    prefix {
-        instance-id = %d
-        eid-prefix = %s/128
-        ms-name = ms-%d
-    }
-    rloc {
-        json-name = signature-%s
-        priority = 255
-    }
-    rloc {
-        json-name = additional-info-%s
-        priority = 255
-    }
-%s
-}
-`
 const (
 	baseFilename = tmpDirname + "/lisp.config.base"
 
@@ -156,46 +32,37 @@ const (
 	RLFilename   = lispDirname + "/RL"
 )
 
-// We write files with the IID-specifics (and not EID) to files
-// in <globalRunDirname>/lisp/<iid>.
-// We write files with the EID-specifics to files named
-// <globalRunDirname>/lisp/<eid>.
-// We concatenate all of those to baseFilename and store the result
-// in destFilename
-//
-// Would be more polite to return an error then to Fatal
-func createLispConfiglet(lispRunDirname string, isMgmt bool, IID uint32,
-	EID net.IP, lispSignature string,
-	globalStatus types.DeviceNetworkStatus,
-	tag string, olIfname string, additionalInfo string,
-	mapservers []types.MapServer, separateDataPlane bool) {
-	if debug {
-		log.Printf("createLispConfiglet: %s %v %d %s %v %s %s %s %s %v\n",
-			lispRunDirname, isMgmt, IID, EID, lispSignature, globalStatus,
-			tag, olIfname, additionalInfo, mapservers)
-	}
-	cfgPathnameIID := lispRunDirname + "/" +
-		strconv.FormatUint(uint64(IID), 10)
-	file1, err := os.Create(cfgPathnameIID)
-	if err != nil {
-		log.Fatal("os.Create for ", cfgPathnameIID, err)
-	}
-	defer file1.Close()
+// debugLisp mirrors the package-wide debug flag but is gated by the
+// STTRACE=lisp (or STTRACE=all) environment variable instead of a command
+// line flag, so tracing can be toggled per subsystem. STTRACE is read only
+// once per process, so a change takes effect after a restart.
+var (
+	debugLisp = logger.Area("lisp")
+	lispLog   = logger.New("lisp")
+)
 
-	var cfgPathnameEID string
-	if isMgmt {
-		// LISP gets confused if the management "lisp interface"
-		// isn't first in the list. Force that for now.
-		cfgPathnameEID = lispRunDirname + "/0-" + EID.String()
-	} else {
-		cfgPathnameEID = lispRunDirname + "/" + EID.String()
-	}
-	file2, err := os.Create(cfgPathnameEID)
-	if err != nil {
-		log.Fatal("os.Create for ", cfgPathnameEID, err)
+// registries holds the typed lispconf.Registry for each lispRunDirname we
+// have been asked to manage. It replaces the earlier scheme of writing
+// per-IID/per-EID files into lispRunDirname and concatenating whatever that
+// directory happened to contain.
+var (
+	registriesLock sync.Mutex
+	registries     = make(map[string]*lispconf.Registry)
+)
+
+func registryFor(lispRunDirname string) *lispconf.Registry {
+	registriesLock.Lock()
+	defer registriesLock.Unlock()
+	reg, ok := registries[lispRunDirname]
+	if !ok {
+		reg = lispconf.NewRegistry()
+		registries[lispRunDirname] = reg
 	}
-	defer file2.Close()
-	rlocString := ""
+	return reg
+}
+
+func rlocsFromUplinks(globalStatus types.DeviceNetworkStatus, withPriority bool) []lispconf.RLOC {
+	var rlocs []lispconf.RLOC
 	for _, u := range globalStatus.UplinkStatus {
 		// Skip interfaces which are not free or have no usable address
 		if !u.Free {
@@ -214,41 +81,51 @@ func createLispConfiglet(lispRunDirname string, isMgmt bool, IID uint32,
 		if !found {
 			continue
 		}
-
-		one := fmt.Sprintf("    rloc {\n        interface = %s\n    }\n",
-			u.IfName)
-		rlocString += one
+		rlocs = append(rlocs, lispconf.RLOC{Interface: u.IfName})
 		for _, i := range u.AddrInfoList {
 			prio := 0
-			if i.Addr.IsLinkLocalUnicast() {
+			if withPriority && i.Addr.IsLinkLocalUnicast() {
 				prio = 2
 			}
-			one := fmt.Sprintf("    rloc {\n        address = %s\n        priority = %d\n    }\n", i.Addr, prio)
-			rlocString += one
+			rlocs = append(rlocs, lispconf.RLOC{Address: i.Addr, Priority: prio})
 		}
 	}
+	return rlocs
+}
+
+func createLispConfiglet(lispRunDirname string, isMgmt bool, IID uint32,
+	EID net.IP, lispSignature string,
+	globalStatus types.DeviceNetworkStatus,
+	tag string, olIfname string, additionalInfo string,
+	mapservers []types.MapServer, separateDataPlane bool) {
+	lispLog.Debugf("createLispConfiglet: %s %v %d %s %v %s %s %s %s %v\n",
+		lispRunDirname, isMgmt, IID, EID, lispSignature, globalStatus,
+		tag, olIfname, additionalInfo, mapservers)
+	reg := registryFor(lispRunDirname)
+
+	var lcMapServers []lispconf.MapServer
 	for _, ms := range mapservers {
-		if isMgmt {
-			file1.WriteString(fmt.Sprintf(lispMStemplateMgmt,
-				ms.NameOrIp, ms.NameOrIp, ms.Credential))
-		} else {
-			file1.WriteString(fmt.Sprintf(lispMStemplate,
-				IID, ms.NameOrIp, ms.Credential))
-		}
-	}
-	file1.WriteString(fmt.Sprintf(lispIIDtemplate, IID))
-	if isMgmt {
-		file2.WriteString(fmt.Sprintf(lispEIDtemplateMgmt,
-			lispSignature, additionalInfo, olIfname, IID))
-		file2.WriteString(fmt.Sprintf(lispDBtemplateMgmt,
-			IID, EID, rlocString))
-	} else {
-		file2.WriteString(fmt.Sprintf(lispEIDtemplate,
-			tag, lispSignature, tag, additionalInfo, olIfname,
-			olIfname, IID))
-		file2.WriteString(fmt.Sprintf(lispDBtemplate,
-			IID, EID, IID, tag, tag, rlocString))
-	}
+		lcMapServers = append(lcMapServers, lispconf.MapServer{
+			NameOrIP:   ms.NameOrIp,
+			Credential: ms.Credential,
+		})
+	}
+	reg.AddIID(lispconf.IIDEntry{IID: IID, IsMgmt: isMgmt, MapServers: lcMapServers})
+
+	reg.AddEID(lispconf.EIDEntry{
+		IID:            IID,
+		EID:            EID,
+		IsMgmt:         isMgmt,
+		Tag:            tag,
+		OlIfname:       olIfname,
+		Signature:      lispSignature,
+		AdditionalInfo: additionalInfo,
+		DB: lispconf.DatabaseMapping{
+			IID:   IID,
+			EID:   EID,
+			RLOCs: rlocsFromUplinks(globalStatus, !isMgmt),
+		},
+	})
 	updateLisp(lispRunDirname, &globalStatus, separateDataPlane)
 }
 
@@ -257,57 +134,24 @@ func createLispEidConfiglet(lispRunDirname string,
 	globalStatus types.DeviceNetworkStatus,
 	tag string, olIfname string, additionalInfo string,
 	mapservers []types.MapServer, separateDataPlane bool) {
-	if debug {
-		log.Printf("createLispConfiglet: %s %d %s %v %s %s %s %s %v\n",
-			lispRunDirname, IID, EID, lispSignature, globalStatus,
-			tag, olIfname, additionalInfo, mapservers)
-	}
-
-	var cfgPathnameEID string
-	cfgPathnameEID = lispRunDirname + "/" + EID.String()
-	file, err := os.Create(cfgPathnameEID)
-	if err != nil {
-		log.Fatal("os.Create for ", cfgPathnameEID, err)
-	}
-	defer file.Close()
-
-	rlocString := ""
-	for _, u := range globalStatus.UplinkStatus {
-		// Skip interfaces which are not free or have no usable address
-		if !u.Free {
-			continue
-		}
-		if len(u.AddrInfoList) == 0 {
-			continue
-		}
-		found := false
-		for _, i := range u.AddrInfoList {
-			if !i.Addr.IsLinkLocalUnicast() {
-				found = true
-				break
-			}
-		}
-		if !found {
-			continue
-		}
-
-		one := fmt.Sprintf("    rloc {\n        interface = %s\n    }\n",
-			u.IfName)
-		rlocString += one
-		for _, i := range u.AddrInfoList {
-			prio := 0
-			if i.Addr.IsLinkLocalUnicast() {
-				prio = 2
-			}
-			one := fmt.Sprintf("    rloc {\n        address = %s\n        priority = %d\n    }\n", i.Addr, prio)
-			rlocString += one
-		}
-	}
-	file.WriteString(fmt.Sprintf(lispEIDtemplate,
-		tag, lispSignature, tag, additionalInfo, olIfname,
-		olIfname, IID))
-	file.WriteString(fmt.Sprintf(lispDBtemplate,
-		IID, EID, IID, tag, tag, rlocString))
+	lispLog.Debugf("createLispEidConfiglet: %s %d %s %v %s %s %s %s %v\n",
+		lispRunDirname, IID, EID, lispSignature, globalStatus,
+		tag, olIfname, additionalInfo, mapservers)
+	reg := registryFor(lispRunDirname)
+	reg.AddEID(lispconf.EIDEntry{
+		IID:            IID,
+		EID:            EID,
+		IsMgmt:         false,
+		Tag:            tag,
+		OlIfname:       olIfname,
+		Signature:      lispSignature,
+		AdditionalInfo: additionalInfo,
+		DB: lispconf.DatabaseMapping{
+			IID:   IID,
+			EID:   EID,
+			RLOCs: rlocsFromUplinks(globalStatus, true),
+		},
+	})
 	updateLisp(lispRunDirname, &globalStatus, separateDataPlane)
 }
 
@@ -317,120 +161,93 @@ func updateLispConfiglet(lispRunDirname string, isMgmt bool, IID uint32,
 	tag string, olIfname string, additionalInfo string,
 	mapservers []types.MapServer,
 	separateDataPlane bool) {
-	if debug {
-		log.Printf("updateLispConfiglet: %s %v %d %s %v %s %s %s %s %v\n",
-			lispRunDirname, isMgmt, IID, EID, lispSignature, globalStatus,
-			tag, olIfname, additionalInfo, mapservers)
-	}
+	lispLog.Debugf("updateLispConfiglet: %s %v %d %s %v %s %s %s %s %v\n",
+		lispRunDirname, isMgmt, IID, EID, lispSignature, globalStatus,
+		tag, olIfname, additionalInfo, mapservers)
+	// AddEID/AddIID replace wholesale, so updating is the same as creating.
 	createLispConfiglet(lispRunDirname, isMgmt, IID, EID, lispSignature,
 		globalStatus, tag, olIfname, additionalInfo, mapservers, separateDataPlane)
 }
 
 func deleteLispConfiglet(lispRunDirname string, isMgmt bool, IID uint32,
 	EID net.IP, globalStatus types.DeviceNetworkStatus, separateDataPlane bool) {
-	if debug {
-		log.Printf("deleteLispConfiglet: %s %d %s %v\n",
-			lispRunDirname, IID, EID, globalStatus)
-	}
-	var cfgPathnameEID string
-	if isMgmt {
-		// LISP gets confused if the management "lisp interface"
-		// isn't first in the list. Force that for now.
-		cfgPathnameEID = lispRunDirname + "/0-" + EID.String()
-	} else {
-		cfgPathnameEID = lispRunDirname + "/" + EID.String()
-	}
-	if err := os.Remove(cfgPathnameEID); err != nil {
-		log.Println(err)
-	}
+	lispLog.Debugf("deleteLispConfiglet: %s %d %s %v\n",
+		lispRunDirname, IID, EID, globalStatus)
+	reg := registryFor(lispRunDirname)
+	reg.DeleteEID(IID, EID)
 
-	// XXX can't delete IID file unless refcnt since other EIDs
+	// XXX can't delete IID entry unless refcnt since other EIDs
 	// can refer to it.
-	// cfgPathnameIID := lispRunDirname + "/" +
-	//	strconv.FormatUint(uint64(IID), 10)
 
 	updateLisp(lispRunDirname, &globalStatus, separateDataPlane)
 }
 
+// updateLisp is now a pure re-render of the in-memory registry: it no
+// longer sweeps lispRunDirname, deciding IID vs EID by whether a file name
+// parses as an integer.
 func updateLisp(lispRunDirname string,
 	globalStatus *types.DeviceNetworkStatus,
 	separateDataPlane bool) {
-	if debug {
-		log.Printf("updateLisp: %s %v\n", lispRunDirname, globalStatus.UplinkStatus)
-	}
+	lispLog.Debugf("updateLisp: %s %v\n", lispRunDirname, globalStatus.UplinkStatus)
 
-	if deferUpdate {
-		log.Printf("updateLisp deferred\n")
-		deferLispRunDirname = lispRunDirname
-		deferGlobalStatus = globalStatus
+	if !deferOrRun(lispRunDirname, globalStatus, separateDataPlane) {
+		lispLog.Debugf("updateLisp deferred")
 		return
 	}
 
-	tmpfile, err := ioutil.TempFile("/tmp/", "lisp")
-	if err != nil {
-		log.Println("TempFile ", err)
-		return
-	}
-	defer tmpfile.Close()
-	defer os.Remove(tmpfile.Name())
+	reg := registryFor(lispRunDirname)
 
-	if debug {
-		log.Printf("Copying from %s to %s\n",
-			baseFilename, tmpfile.Name())
-	}
 	content, err := ioutil.ReadFile(baseFilename)
 	if err != nil {
-		log.Printf("Reading base configuration file %s failed: %s\n",
-			baseFilename, err)
+		lispLog.Errorf("reading base configuration file %s failed: %s", baseFilename, err)
 		return
 	}
 	baseConfig := string(content)
+	separate := "no"
 	if separateDataPlane {
-		tmpfile.WriteString(fmt.Sprintf(baseConfig, "yes"))
-	} else {
-		tmpfile.WriteString(fmt.Sprintf(baseConfig, "no"))
+		separate = "yes"
 	}
 
-	var cnt int64
-	files, err := ioutil.ReadDir(lispRunDirname)
+	// Render into an in-memory buffer first so a bad registry state can
+	// never half-overwrite destFilename; this is the atomic dry-run
+	// validation the filesystem sweep could not give us.
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf(baseConfig, separate))
+	if err := lispconf.Render(&buf, reg, lispconf.LispersNet); err != nil {
+		lispLog.Errorf("rendering lisp config failed: %s", err)
+		return
+	}
+
+	eidCount := reg.EIDCount()
+	devices := strings.Join(reg.Devices(), " ")
+	lispLog.Debugf("updateLisp: found %d EIDs devices <%v>\n",
+		eidCount, devices)
+	freeUpLinks := types.GetUplinkFreeNoLocal(*globalStatus)
+	for _, u := range freeUpLinks {
+		devices += " " + u.IfName
+	}
+
+	// This seems safer; make sure it is stopped before rewriting file
+	stopLisp()
+
+	tmpfile, err := ioutil.TempFile("/tmp/", "lisp")
 	if err != nil {
-		log.Println(err)
+		lispLog.Errorf("creating temp file failed: %s", err)
 		return
 	}
-	eidCount := 0
-	for _, file := range files {
-		// The IID files are named by the IID hence an integer
-		if _, err := strconv.Atoi(file.Name()); err != nil {
-			eidCount += 1
-		}
-		filename := lispRunDirname + "/" + file.Name()
-		if debug {
-			log.Printf("Copying from %s to %s\n",
-				filename, tmpfile.Name())
-		}
-		s, err := os.Open(filename)
-		if err != nil {
-			log.Println("os.Open ", filename, err)
-			return
-		}
-		defer s.Close()
-		if cnt, err = io.Copy(tmpfile, s); err != nil {
-			log.Println("io.Copy ", filename, err)
-			return
-		}
-		if debug {
-			log.Printf("Copied %d bytes from %s\n", cnt, filename)
-		}
+	defer os.Remove(tmpfile.Name())
+	if _, err := tmpfile.Write(buf.Bytes()); err != nil {
+		lispLog.Errorf("writing to %s failed: %s", tmpfile.Name(), err)
+		tmpfile.Close()
+		return
 	}
 	if err := tmpfile.Close(); err != nil {
-		log.Println("Close ", tmpfile.Name(), err)
+		lispLog.Errorf("closing %s failed: %s", tmpfile.Name(), err)
 		return
 	}
-	// This seems safer; make sure it is stopped before rewriting file
-	stopLisp()
 
 	if err := os.Rename(tmpfile.Name(), destFilename); err != nil {
-		log.Println("Rename ", tmpfile.Name(), destFilename, err)
+		lispLog.Errorf("renaming %s to %s failed: %s", tmpfile.Name(), destFilename, err)
 		return
 	}
 	// XXX We write configuration to lisp.config.orig for debugging
@@ -441,31 +258,6 @@ func updateLisp(lispRunDirname string,
 		f.Sync()
 	}
 
-	// Determine the set of devices from the above config file
-	grep := wrap.Command("grep", "device = ", destFilename)
-	awk := wrap.Command("awk", "{print $NF}")
-	awk.Stdin, _ = grep.StdoutPipe()
-	if err := grep.Start(); err != nil {
-		log.Println("grep.Start failed: ", err)
-		return
-	}
-	intfs, err := awk.Output()
-	if err != nil {
-		log.Println("awk.Output failed: ", err)
-		return
-	}
-	_ = grep.Wait()
-	_ = awk.Wait()
-	devices := strings.TrimSpace(string(intfs))
-	devices = strings.Replace(devices, "\n", " ", -1)
-	if debug {
-		log.Printf("updateLisp: found %d EIDs devices <%v>\n",
-			eidCount, devices)
-	}
-	freeUpLinks := types.GetUplinkFreeNoLocal(*globalStatus)
-	for _, u := range freeUpLinks {
-		devices += " " + u.IfName
-	}
 	// Check how many EIDs we have configured. If none we stop lisp
 	if eidCount == 0 {
 		stopLisp()
@@ -480,47 +272,85 @@ func updateLisp(lispRunDirname string,
 	}
 }
 
-var deferUpdate = false
-var deferLispRunDirname = ""
-var deferGlobalStatus *types.DeviceNetworkStatus
+// reconcile serializes updateLisp calls: while a restart is in flight any
+// further request is coalesced into a single pending one that runs as soon
+// as the in-flight restart completes. This replaces the previous
+// deferUpdate/deferLispRunDirname/deferGlobalStatus package globals, which
+// could only coalesce a single pending request and had no notion of "a
+// restart is currently running".
+type reconcileRequest struct {
+	lispRunDirname    string
+	globalStatus      *types.DeviceNetworkStatus
+	separateDataPlane bool
+}
+
+var (
+	reconcileLock    sync.Mutex
+	reconcileRunning bool
+	reconcilePending *reconcileRequest
+)
 
 func handleLispRestart(done bool, separateDataPlane bool) {
-	if debug {
-		log.Printf("handleLispRestart(%v)\n", done)
-	}
+	lispLog.Debugf("handleLispRestart(%v)\n", done)
+	reconcileLock.Lock()
+	reconcileRunning = !done
+	pending := reconcilePending
 	if done {
-		if deferUpdate {
-			deferUpdate = false
-			if deferLispRunDirname != "" {
-				updateLisp(deferLispRunDirname,
-					deferGlobalStatus, separateDataPlane)
-				deferLispRunDirname = ""
-				deferGlobalStatus = nil
-			}
+		reconcilePending = nil
+	}
+	reconcileLock.Unlock()
+
+	if done && pending != nil {
+		updateLisp(pending.lispRunDirname, pending.globalStatus,
+			pending.separateDataPlane)
+	}
+}
+
+// deferOrRun is called by updateLisp in place of the old deferUpdate check.
+// It reports whether the caller should proceed immediately (true) or has
+// been queued to run once the in-flight restart reports done (false).
+func deferOrRun(lispRunDirname string, globalStatus *types.DeviceNetworkStatus,
+	separateDataPlane bool) bool {
+
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+	if reconcileRunning {
+		reconcilePending = &reconcileRequest{
+			lispRunDirname:    lispRunDirname,
+			globalStatus:      globalStatus,
+			separateDataPlane: separateDataPlane,
 		}
-	} else {
-		deferUpdate = true
+		return false
 	}
+	return true
 }
 
+// lispDataPlaneSupervisor owns the separate lisp-ztr dataplane, a genuinely
+// long-running process whose exit (clean or not) means the dataplane is
+// down and procsup.Supervisor should restart it. It's created lazily since
+// the args it needs aren't known until the first start call.
+//
+// lisp-core is not supervised the same way: RESTART-LISP/STOP-LISP are
+// one-shot launcher scripts (see pkillLispCore's "lisp-core.pyo" target)
+// that fork lisp-core and exit almost immediately themselves, so a
+// procsup.Supervisor wrapped around RestartCmd would see that exit as an
+// unexpected crash and restart-loop the launcher forever even though
+// lisp-core is still running fine. restartLisp runs RestartCmd directly
+// instead, the same way stopLisp already runs StopCmd directly.
+var (
+	supervisorLock          sync.Mutex
+	lispDataPlaneSupervisor *procsup.Supervisor
+)
+
 func restartLisp(upLinkStatus []types.NetworkUplink, devices string) {
-	if debug {
-		log.Printf("restartLisp: %v %s\n", upLinkStatus, devices)
-	}
+	lispLog.Debugf("restartLisp: %v %s\n", upLinkStatus, devices)
 	if len(upLinkStatus) == 0 {
-		log.Printf("Can not restart lisp with no uplinks\n")
+		lispLog.Warnf("can not restart lisp with no uplinks")
 		return
 	}
 	// XXX hack to avoid hang in pslisp on Erik's laptop
 	if broken {
-		// Issue pkill -f lisp-core.pyo
-		log.Printf("Calling pkill -f lisp-core.pyo\n")
-		cmd := wrap.Command("pkill", "-f", "lisp-core.pyo")
-		stdoutStderr, err := cmd.CombinedOutput()
-		if err != nil {
-			log.Println("pkill failed ", err)
-			log.Printf("pkill output %s\n", string(stdoutStderr))
-		}
+		pkillLispCore()
 	}
 	// XXX how to restart with multiple uplinks?
 	// Find first free uplink with a non-link-local IPv6, or an IPv4 address
@@ -546,34 +376,34 @@ func restartLisp(upLinkStatus []types.NetworkUplink, devices string) {
 		}
 	}
 	if !found {
-		log.Printf("Can not restart lisp - no usable IP addresses on free uplinks\n")
+		lispLog.Warnf("can not restart lisp - no usable IP addresses on free uplinks")
 		return
 	}
 
-	args := []string{
-		RestartCmd,
-		"8080",
-		uplink.IfName,
-	}
 	itrTimeout := 1
-	cmd := wrap.Command(RestartCmd)
-	cmd.Args = args
-	env := os.Environ()
-	env = append(env, fmt.Sprintf("LISP_NO_IPTABLES="))
-	env = append(env, fmt.Sprintf("LISP_PCAP_LIST=%s", devices))
-	// Make sure the ITR doesn't give up to early; maybe it should
-	// wait forever? Will we be dead for this time?
-	env = append(env, fmt.Sprintf("LISP_ITR_WAIT_TIME=%d", itrTimeout))
-	cmd.Env = env
+	newCmd := func() *exec.Cmd {
+		cmd := wrap.Command(RestartCmd)
+		cmd.Args = []string{RestartCmd, "8080", uplink.IfName}
+		env := os.Environ()
+		env = append(env, "LISP_NO_IPTABLES=")
+		env = append(env, fmt.Sprintf("LISP_PCAP_LIST=%s", devices))
+		// Make sure the ITR doesn't give up too early; maybe it should
+		// wait forever? Will we be dead for this time?
+		env = append(env, fmt.Sprintf("LISP_ITR_WAIT_TIME=%d", itrTimeout))
+		cmd.Env = env
+		return cmd
+	}
+
+	cmd := newCmd()
 	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Println("RESTART-LISP failed ", err)
-		log.Printf("RESTART-LISP output %s\n", string(stdoutStderr))
+		lispLog.Errorf("RESTART-LISP failed: %s", err)
+		lispLog.Errorf("RESTART-LISP output %s", string(stdoutStderr))
 		return
 	}
-	if debug {
-		log.Printf("restartLisp done: output %s\n",
-			string(stdoutStderr))
+	lispLog.Debugf("restartLisp done: output %s\n", string(stdoutStderr))
+	if err := lispCoreControlProbe(); err != nil {
+		lispLog.Warnf("restartLisp: %s", err)
 	}
 
 	// Save the restart as a bash command called RL
@@ -587,111 +417,91 @@ func restartLisp(upLinkStatus []types.NetworkUplink, devices string) {
 
 	b := []byte(fmt.Sprintf(RLTemplate, devices, itrTimeout, RestartCmd,
 		uplink.IfName))
-	err = ioutil.WriteFile(RLFilename, b, 0744)
-	if err != nil {
-		log.Fatal("WriteFile", err, RLFilename)
+	if err := ioutil.WriteFile(RLFilename, b, 0744); err != nil {
+		lispLog.Errorf("WriteFile %s failed: %s", RLFilename, err)
 		return
 	}
-	if debug {
-		log.Printf("Wrote %s\n", RLFilename)
-	}
+	lispLog.Debugf("Wrote %s\n", RLFilename)
 }
 
-func maybeStartLispDataPlane() {
-	if debug {
-		log.Printf("maybeStartLispDataPlane: %s\n", "/opt/zededa/bin/lisp-ztr")
-	}
-	isRunning, _ := isLispDataPlaneRunning()
-	if isRunning {
-		return
-	}
-	// Dataplane is currently not running. Start it.
-	cmd := "nohup"
-	args := []string{
-		"/opt/zededa/bin/lisp-ztr",
+// lispCoreControlProbe checks that lispers.net's control endpoint on
+// localhost:8080 accepts connections; restartLisp calls it once right after
+// RestartCmd exits to confirm lisp-core actually came up.
+func lispCoreControlProbe() error {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:8080", 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("lisp-core control endpoint unreachable: %w", err)
 	}
-	go wrap.Command(cmd, args...).Output()
+	conn.Close()
+	return nil
 }
 
-// Stop if dataplane(lisp-ztr) is running
-// return true if dataplane was running and we stopped it.
-// false otherwise
-func maybeStopLispDataPlane() bool {
-	isRunning, pids := isLispDataPlaneRunning()
-	if isRunning {
-		// kill all the dataplane processes
-		for _, pid := range pids {
-			cmd := wrap.Command("kill", "-9", pid)
-			_, err := cmd.CombinedOutput()
-			if err != nil {
-				fmt.Printf("maybeStopLispDataPlane: Killing pid %s failed: %s\n",
-					pid, err)
-			}
-		}
-		return true
+func pkillLispCore() {
+	// Issue pkill -f lisp-core.pyo
+	lispLog.Debugf("calling pkill -f lisp-core.pyo")
+	cmd := wrap.Command("pkill", "-f", "lisp-core.pyo")
+	stdoutStderr, err := cmd.CombinedOutput()
+	if err != nil {
+		lispLog.Warnf("pkill failed: %s", err)
+		lispLog.Warnf("pkill output %s", string(stdoutStderr))
 	}
-	return false
 }
 
-func isLispDataPlaneRunning() (bool, []string) {
-	prog := DataPlaneName
-
-	// create pgrep command to see if dataplane is running
-	cmd := wrap.Command("pgrep", "-x", prog)
-
-	// pgrep returns 0 when there is atleast one matching program running
-	// cmd.Output returns nil when pgrep returns 0, otherwise pids.
-	out, err := cmd.Output()
-
-	if err != nil {
-		log.Printf("isLispDataPlaneRunning: %s process is not running: %s\n",
-			prog, err)
-		return false, []string{}
+func maybeStartLispDataPlane() {
+	lispLog.Debugf("maybeStartLispDataPlane: %s\n", "/opt/zededa/bin/lisp-ztr")
+	supervisorLock.Lock()
+	if lispDataPlaneSupervisor == nil {
+		lispDataPlaneSupervisor = procsup.NewSupervisor(DataPlaneName,
+			func() *exec.Cmd { return wrap.Command("/opt/zededa/bin/lisp-ztr") },
+			nil, 0, procsup.DefaultRestartPolicy)
 	}
-	log.Printf("isLispDataPlaneRunning: Instances of %s is running.\n", prog)
-	pids := strings.Split(string(out), "\n")
+	sup := lispDataPlaneSupervisor
+	supervisorLock.Unlock()
 
-	// The last entry returned by strings.Split is an empty string.
-	// splice the last entry out.
-	pids = pids[:len(pids)-1]
+	if err := sup.Start(); err != nil {
+		lispLog.Errorf("maybeStartLispDataPlane: %s", err)
+	}
+}
 
-	return true, pids
+// Stop the dataplane (lisp-ztr) if we started it.
+// return true if dataplane was running and we stopped it.
+// false otherwise
+func maybeStopLispDataPlane() bool {
+	supervisorLock.Lock()
+	sup := lispDataPlaneSupervisor
+	supervisorLock.Unlock()
+	if sup == nil {
+		return false
+	}
+	healthy, _ := sup.Healthy()
+	if err := sup.Stop(); err != nil {
+		lispLog.Errorf("maybeStopLispDataPlane: %s", err)
+		return false
+	}
+	return healthy
 }
 
 func stopLisp() {
-	if debug {
-		log.Printf("stopLisp\n")
-	}
+	lispLog.Debugf("stopLisp\n")
 	// XXX hack to avoid hang in pslisp on Erik's laptop
 	if broken {
-		// Issue pkill -f lisp-core.pyo
-		log.Printf("Calling pkill -f lisp-core.pyo\n")
-		cmd := wrap.Command("pkill", "-f", "lisp-core.pyo")
-		stdoutStderr, err := cmd.CombinedOutput()
-		if err != nil {
-			log.Println("pkill failed ", err)
-			log.Printf("pkill output %s\n", string(stdoutStderr))
-		}
+		pkillLispCore()
 	}
 
 	cmd := wrap.Command(StopCmd)
 	env := os.Environ()
-	env = append(env, fmt.Sprintf("LISP_NO_IPTABLES="))
+	env = append(env, "LISP_NO_IPTABLES=")
 	cmd.Env = env
 	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Println("STOP-LISP failed ", err)
-		log.Printf("STOP-LISP output %s\n", string(stdoutStderr))
+		lispLog.Errorf("STOP-LISP failed: %s", err)
+		lispLog.Errorf("STOP-LISP output %s", string(stdoutStderr))
 		return
 	}
-	if debug {
-		log.Printf("stopLisp done: output %s\n", string(stdoutStderr))
-	}
+	lispLog.Debugf("stopLisp done: output %s\n", string(stdoutStderr))
 	if err = os.Remove(RLFilename); err != nil {
-		log.Println(err)
+		lispLog.Warnf("removing %s failed: %s", RLFilename, err)
 		return
 	}
-	if debug {
-		log.Printf("Removed %s\n", RLFilename)
-	}
+	lispLog.Debugf("Removed %s\n", RLFilename)
 }
@@ -0,0 +1,309 @@
+// Copyright (c) 2017 Zededa, Inc.
+// All rights reserved.
+
+// Package lispconf holds a typed, in-memory representation of the lispers.net
+// configuration that zedrouter drives, plus renderers that turn it into the
+// on-disk forms consumed by lisp-core and lisp-ztr.
+//
+// This replaces the previous approach of sprintf'ing text templates into
+// per-IID/per-EID files under lispRunDirname and concatenating whatever the
+// directory happened to contain. Callers now add/update/delete typed entries
+// in a Registry and call Render to produce a specific backend's output.
+package lispconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+// MapServer is a single lisp map-server/map-resolver entry.
+type MapServer struct {
+	NameOrIP   string
+	Credential string
+}
+
+// RLOC is a single routing locator: either an uplink interface name (used
+// for the pcap-based ITR binding) or an address with a priority.
+type RLOC struct {
+	Interface string
+	Address   net.IP
+	Priority  int
+}
+
+// DatabaseMapping is the eid-prefix/rloc set registered with the map-server
+// for a given (IID, EID).
+type DatabaseMapping struct {
+	IID    uint32
+	EID    net.IP
+	MSName string
+	RLOCs  []RLOC
+}
+
+// IIDEntry is the instance-id level configuration: the map-cache entry and
+// the set of map-servers serving that IID.
+type IIDEntry struct {
+	IID        uint32
+	IsMgmt     bool
+	MapServers []MapServer
+}
+
+// EIDEntry is one overlay interface's EID-level configuration: the
+// signature/additional-info json blobs, the lisp interface binding, and the
+// associated DatabaseMapping.
+type EIDEntry struct {
+	IID            uint32
+	EID            net.IP
+	IsMgmt         bool
+	Tag            string
+	OlIfname       string
+	Signature      string
+	AdditionalInfo string
+	DB             DatabaseMapping
+}
+
+type key struct {
+	iid uint32
+	eid string
+}
+
+// Registry is an in-memory, keyed store of the current lisp configuration.
+// It replaces the filesystem-as-database pattern where IID vs EID was
+// decided by whether a file name happened to parse as an integer.
+type Registry struct {
+	mu   sync.Mutex
+	iids map[uint32]IIDEntry
+	eids map[key]EIDEntry
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		iids: make(map[uint32]IIDEntry),
+		eids: make(map[key]EIDEntry),
+	}
+}
+
+// AddIID adds or replaces the IID-level entry for e.IID.
+func (r *Registry) AddIID(e IIDEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.iids[e.IID] = e
+}
+
+// DeleteIID removes the IID-level entry, if present.
+func (r *Registry) DeleteIID(iid uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.iids, iid)
+}
+
+// AddEID adds or replaces the EID-level entry keyed by (e.IID, e.EID).
+func (r *Registry) AddEID(e EIDEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.eids[key{e.IID, e.EID.String()}] = e
+}
+
+// UpdateEID is an alias for AddEID; entries are replaced wholesale.
+func (r *Registry) UpdateEID(e EIDEntry) {
+	r.AddEID(e)
+}
+
+// DeleteEID removes the EID-level entry for (iid, eid), if present.
+func (r *Registry) DeleteEID(iid uint32, eid net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.eids, key{iid, eid.String()})
+}
+
+// EIDCount returns the number of EID entries currently registered, which is
+// what updateLisp used to derive by counting non-integer file names.
+func (r *Registry) EIDCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.eids)
+}
+
+// Devices returns the sorted set of overlay interface names (OlIfname)
+// referenced by the registered EIDs, replacing the grep/awk pass over
+// destFilename that built LISP_PCAP_LIST. Uplink names are not included.
+func (r *Registry) Devices() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[string]bool)
+	var devices []string
+	for _, e := range r.eids {
+		if e.OlIfname == "" || seen[e.OlIfname] {
+			continue
+		}
+		seen[e.OlIfname] = true
+		devices = append(devices, e.OlIfname)
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// sortedEIDs returns the registered EID entries in the deterministic order
+// Render needs: management EIDs first, then app EIDs, each ordered by IID
+// then EID string.
+func (r *Registry) sortedEIDs() []EIDEntry {
+	entries := make([]EIDEntry, 0, len(r.eids))
+	for _, e := range r.eids {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsMgmt != entries[j].IsMgmt {
+			return entries[i].IsMgmt
+		}
+		if entries[i].IID != entries[j].IID {
+			return entries[i].IID < entries[j].IID
+		}
+		return entries[i].EID.String() < entries[j].EID.String()
+	})
+	return entries
+}
+
+// sortedIIDs returns the registered IID entries ordered by IID.
+func (r *Registry) sortedIIDs() []IIDEntry {
+	entries := make([]IIDEntry, 0, len(r.iids))
+	for _, e := range r.iids {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].IID < entries[j].IID
+	})
+	return entries
+}
+
+// Backend renders a Registry's contents into a specific on-disk form.
+type Backend interface {
+	// Render walks reg in a deterministic order and writes the backend's
+	// representation to w. The lispers.net backend emits management EIDs,
+	// then IIDs, then app EIDs; the JSON backend emits all IIDs, then all
+	// EIDs (management EIDs first).
+	Render(w io.Writer, reg *Registry) error
+}
+
+// Render produces backend's output for reg. It never mutates reg, so it is
+// safe to use for dry-run validation before a restart is attempted.
+func Render(w io.Writer, reg *Registry, backend Backend) error {
+	return backend.Render(w, reg)
+}
+
+// lispersNetBackend emits the textual lispers.net lisp.config format that
+// lisp-core currently consumes.
+type lispersNetBackend struct{}
+
+// LispersNet is the Backend that produces the lispers.net textual format.
+var LispersNet Backend = lispersNetBackend{}
+
+func (lispersNetBackend) Render(w io.Writer, reg *Registry) error {
+	reg.mu.Lock()
+	eids := reg.sortedEIDs()
+	iids := reg.sortedIIDs()
+	reg.mu.Unlock()
+
+	// Management EIDs first.
+	for _, e := range eids {
+		if !e.IsMgmt {
+			continue
+		}
+		if err := writeMgmtEID(w, e); err != nil {
+			return err
+		}
+	}
+	// Then IIDs (map-servers and map-cache entries).
+	for _, iid := range iids {
+		for _, ms := range iid.MapServers {
+			if iid.IsMgmt {
+				if _, err := fmt.Fprintf(w, lispMStemplateMgmt, ms.NameOrIP, ms.NameOrIP, ms.Credential); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := fmt.Fprintf(w, lispMStemplate, iid.IID, ms.NameOrIP, ms.Credential); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, lispIIDtemplate, iid.IID); err != nil {
+			return err
+		}
+	}
+	// Then application EIDs.
+	for _, e := range eids {
+		if e.IsMgmt {
+			continue
+		}
+		if err := writeAppEID(w, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMgmtEID(w io.Writer, e EIDEntry) error {
+	if _, err := fmt.Fprintf(w, lispEIDtemplateMgmt, e.Signature, e.AdditionalInfo,
+		e.OlIfname, e.IID); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, lispDBtemplateMgmt, e.IID, e.EID, rlocString(e.DB.RLOCs, false))
+	return err
+}
+
+func writeAppEID(w io.Writer, e EIDEntry) error {
+	if _, err := fmt.Fprintf(w, lispEIDtemplate, e.Tag, e.Signature, e.Tag,
+		e.AdditionalInfo, e.OlIfname, e.OlIfname, e.IID); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, lispDBtemplate, e.IID, e.EID, e.IID, e.Tag, e.Tag,
+		rlocString(e.DB.RLOCs, true))
+	return err
+}
+
+func rlocString(rlocs []RLOC, withPriority bool) string {
+	s := ""
+	for _, r := range rlocs {
+		if r.Interface != "" {
+			s += fmt.Sprintf("    rloc {\n        interface = %s\n    }\n", r.Interface)
+			continue
+		}
+		if withPriority {
+			s += fmt.Sprintf("    rloc {\n        address = %s\n        priority = %d\n    }\n",
+				r.Address, r.Priority)
+		} else {
+			s += fmt.Sprintf("    rloc {\n        address = %s\n    }\n", r.Address)
+		}
+	}
+	return s
+}
+
+// jsonBackend emits a JSON form of the registry for the separate lisp-ztr
+// dataplane, which does not parse lispers.net's textual config.
+type jsonBackend struct{}
+
+// JSON is the Backend that produces the lisp-ztr JSON form.
+var JSON Backend = jsonBackend{}
+
+// jsonDoc mirrors the fields lisp-ztr needs; it is intentionally decoupled
+// from the internal Registry layout so the wire format can evolve on its
+// own.
+type jsonDoc struct {
+	IIDs []IIDEntry `json:"iids"`
+	EIDs []EIDEntry `json:"eids"`
+}
+
+func (jsonBackend) Render(w io.Writer, reg *Registry) error {
+	reg.mu.Lock()
+	doc := jsonDoc{
+		IIDs: reg.sortedIIDs(),
+		EIDs: reg.sortedEIDs(),
+	}
+	reg.mu.Unlock()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
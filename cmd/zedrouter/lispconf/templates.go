@@ -0,0 +1,137 @@
+// Copyright (c) 2017 Zededa, Inc.
+// All rights reserved.
+
+package lispconf
+
+// These are the lispers.net text fragments the lispersNetBackend fills in.
+// They were moved here unchanged from zedrouter/lisp.go so that the textual
+// format stays exactly what lisp-core already expects.
+
+// Template per map server. Pass in (dns-name, dns-name, authentication-key)
+// Use this for the Mgmt IID
+const lispMStemplateMgmt = `
+lisp map-resolver {
+	dns-name = %s
+}
+lisp map-server {
+    dns-name = %s
+    authentication-key = %s
+    want-map-notify = yes
+}
+`
+
+// Template per map server. Pass in (IID, dns-name, authentication-key)
+const lispMStemplate = `
+lisp map-server {
+    ms-name = ms-%d
+    dns-name = %s
+    authentication-key = %s
+    want-map-notify = yes
+}
+`
+
+// Need to fill in IID in 1 place
+const lispIIDtemplate = `
+lisp map-cache {
+    prefix {
+        instance-id = %d
+        eid-prefix = fd00::/8
+		send-map-request = yes
+    }
+}
+`
+
+// Need to fill in (signature, additional, olIfname, IID)
+// Use this for the Mgmt IID/EID
+const lispEIDtemplateMgmt = `
+lisp json {
+    json-name = signature
+    json-string = { "signature" : "%s" }
+}
+
+lisp json {
+    json-name = additional-info
+    json-string = %s
+}
+
+lisp interface {
+    interface-name = overlay-mgmt
+    device = %s
+    instance-id = %d
+}
+`
+
+// Need to pass in (IID, EID, rlocs), where rlocs is a string with
+// sets of uplink info with:
+// rloc {
+//        interface = %s
+// }
+// rloc {
+//        address = %s
+// }
+const lispDBtemplateMgmt = `
+lisp database-mapping {
+    prefix {
+        instance-id = %d
+        eid-prefix = %s/128
+        signature-eid = yes
+    }
+    rloc {
+        json-name = signature
+        priority = 255
+    }
+    rloc {
+        json-name = additional-info
+        priority = 255
+    }
+%s
+}
+`
+
+// Need to fill in (tag, signature, tag, additional, olifname, olifname, IID)
+// Use this for the application EIDs
+const lispEIDtemplate = `
+lisp json {
+    json-name = signature-%s
+    json-string = { "signature" : "%s" }
+}
+
+lisp json {
+    json-name = additional-info-%s
+    json-string = %s
+}
+
+lisp interface {
+    interface-name = overlay-%s
+    device = %s
+    instance-id = %d
+}
+`
+
+// Need to fill in (IID, EID, IID, tag, tag, rlocs) where
+// rlocs is a string with sets of uplink info with:
+// rloc {
+//        interface = %s
+// }
+// rloc {
+//        address = %s
+//        priority = %d
+// }
+const lispDBtemplate = `
+lisp database-mapping {
+    prefix {
+        instance-id = %d
+        eid-prefix = %s/128
+        ms-name = ms-%d
+    }
+    rloc {
+        json-name = signature-%s
+        priority = 255
+    }
+    rloc {
+        json-name = additional-info-%s
+        priority = 255
+    }
+%s
+}
+`
@@ -0,0 +1,346 @@
+// Copyright (c) 2017 Zededa, Inc.
+// All rights reserved.
+
+// Package procsup owns the lifecycle of a child process zedrouter depends
+// on (the lisp-ztr dataplane) so that starting, stopping, and restarting it
+// goes through one serialized place instead of racing goroutines and
+// pgrep/kill. lisp-core is not run through a Supervisor: zedrouter invokes
+// its RESTART-LISP/STOP-LISP scripts directly.
+package procsup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ringBufferSize bounds how much combined stdout/stderr we keep per child.
+const ringBufferSize = 64 * 1024
+
+// Probe reports whether the supervised process is healthy. It is called
+// periodically while the process is believed to be running.
+type Probe func() error
+
+// RestartPolicy controls what Supervisor does when the child exits or a
+// liveness probe fails.
+type RestartPolicy struct {
+	// OnFailure restarts the child after it exits unexpectedly or fails
+	// its probe; if false the Supervisor just records the failure.
+	OnFailure bool
+	// MaxRetries is the number of failure-driven restart attempts allowed
+	// before the Supervisor gives up and reports a permanent failure. The
+	// count accumulates across failures and is reset only by Restart.
+	// Zero means unlimited.
+	MaxRetries int
+	// MinBackoff/MaxBackoff bound the exponential backoff applied between
+	// restart attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRestartPolicy is a reasonable on-failure policy with capped
+// exponential backoff.
+var DefaultRestartPolicy = RestartPolicy{
+	OnFailure:  true,
+	MaxRetries: 0,
+	MinBackoff: time.Second,
+	MaxBackoff: time.Minute,
+}
+
+// Supervisor owns a single managed child process: starting it, capturing
+// its output, running a liveness probe against it, and applying a restart
+// policy when it dies or fails its probe.
+type Supervisor struct {
+	// Name identifies the child in logs and status; e.g. "lisp-core" or
+	// "lisp-ztr".
+	Name string
+	// NewCmd builds a fresh *exec.Cmd for each (re)start; it must return a
+	// command that has not yet been started.
+	NewCmd func() *exec.Cmd
+	// Probe, if non-nil, is polled every ProbeInterval while the child is
+	// believed to be running.
+	Probe         Probe
+	ProbeInterval time.Duration
+	Policy        RestartPolicy
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	output   *ringBuffer
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	retries  int
+	lastErr  error
+	running  bool
+	stopping bool
+}
+
+// NewSupervisor constructs a Supervisor with the given policy. A zero value
+// Policy is replaced with DefaultRestartPolicy.
+func NewSupervisor(name string, newCmd func() *exec.Cmd, probe Probe,
+	probeInterval time.Duration, policy RestartPolicy) *Supervisor {
+
+	if policy == (RestartPolicy{}) {
+		policy = DefaultRestartPolicy
+	}
+	return &Supervisor{
+		Name:          name,
+		NewCmd:        newCmd,
+		Probe:         probe,
+		ProbeInterval: probeInterval,
+		Policy:        policy,
+		output:        newRingBuffer(ringBufferSize),
+	}
+}
+
+// Start launches the child if it is not already running and begins the
+// supervise loop that applies Probe/Policy. Start is idempotent.
+func (s *Supervisor) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return nil
+	}
+	if err := s.startLocked(); err != nil {
+		return err
+	}
+	s.stopCh = make(chan struct{})
+	s.doneCh = make(chan struct{})
+	go s.superviseLoop(s.stopCh, s.doneCh)
+	return nil
+}
+
+func (s *Supervisor) startLocked() error {
+	cmd := s.NewCmd()
+	cmd.Stdout = s.output
+	cmd.Stderr = s.output
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("procsup: starting %s failed: %w", s.Name, err)
+	}
+	s.cmd = cmd
+	s.running = true
+	return nil
+}
+
+// Stop terminates the child and the supervise loop; Stop is idempotent.
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.stopping = true
+	cmd := s.cmd
+	stopCh := s.stopCh
+	doneCh := s.doneCh
+	s.mu.Unlock()
+
+	close(stopCh)
+	if cmd != nil && cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+	<-doneCh
+
+	s.mu.Lock()
+	s.running = false
+	s.stopping = false
+	s.mu.Unlock()
+	return nil
+}
+
+// Restart stops the child (if running) and starts a fresh instance,
+// resetting the retry counter since this is an operator-driven restart
+// rather than a failure-driven one.
+func (s *Supervisor) Restart() error {
+	if err := s.Stop(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.retries = 0
+	s.mu.Unlock()
+	return s.Start()
+}
+
+// Healthy reports whether the last known state of the child is good: it is
+// running and, if a Probe is configured, the most recent probe succeeded.
+func (s *Supervisor) Healthy() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return false, s.lastErr
+	}
+	if s.Probe == nil {
+		return true, nil
+	}
+	return s.lastErr == nil, s.lastErr
+}
+
+// Output returns the captured combined stdout/stderr of the child, bounded
+// to the ring buffer size.
+func (s *Supervisor) Output() []byte {
+	return s.output.Bytes()
+}
+
+func (s *Supervisor) superviseLoop(stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+
+	waitCh := make(chan error, 1)
+	s.mu.Lock()
+	cmd := s.cmd
+	s.mu.Unlock()
+	go func() { waitCh <- cmd.Wait() }()
+
+	var probeTicker *time.Ticker
+	var probeCh <-chan time.Time
+	if s.Probe != nil && s.ProbeInterval > 0 {
+		probeTicker = time.NewTicker(s.ProbeInterval)
+		probeCh = probeTicker.C
+		defer probeTicker.Stop()
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case err := <-waitCh:
+			s.recordFailure(fmt.Errorf("procsup: %s exited: %w", s.Name, err))
+			if !s.maybeRestart(stopCh, doneCh) {
+				s.mu.Lock()
+				s.running = false
+				s.mu.Unlock()
+				return
+			}
+			s.mu.Lock()
+			cmd = s.cmd
+			s.mu.Unlock()
+			go func() { waitCh <- cmd.Wait() }()
+		case <-probeCh:
+			if err := s.Probe(); err != nil {
+				s.recordFailure(fmt.Errorf("procsup: %s failed liveness probe: %w", s.Name, err))
+				if cmd.Process != nil {
+					_ = cmd.Process.Kill()
+				}
+			} else {
+				s.clearFailure()
+			}
+		}
+	}
+}
+
+// maybeRestart applies the restart policy after a failure. It returns false
+// if the caller should stop supervising (either restarts are disabled,
+// retries are exhausted, or a Stop() is in progress).
+func (s *Supervisor) maybeRestart(stopCh, doneCh chan struct{}) bool {
+	s.mu.Lock()
+	stopping := s.stopping
+	s.mu.Unlock()
+	if stopping || !s.Policy.OnFailure {
+		return false
+	}
+
+	s.mu.Lock()
+	s.retries++
+	retries := s.retries
+	s.mu.Unlock()
+	if s.Policy.MaxRetries > 0 && retries > s.Policy.MaxRetries {
+		s.recordFailure(fmt.Errorf("procsup: %s exceeded %d restart attempts",
+			s.Name, s.Policy.MaxRetries))
+		return false
+	}
+
+	backoff := expBackoff(s.Policy.MinBackoff, s.Policy.MaxBackoff, retries)
+	select {
+	case <-time.After(backoff):
+	case <-stopCh:
+		return false
+	}
+
+	s.mu.Lock()
+	err := s.startLocked()
+	s.mu.Unlock()
+	if err != nil {
+		s.recordFailure(err)
+		return false
+	}
+	return true
+}
+
+func expBackoff(min, max time.Duration, attempt int) time.Duration {
+	if min <= 0 {
+		min = time.Second
+	}
+	d := min << uint(attempt-1)
+	if d <= 0 || (max > 0 && d > max) {
+		d = max
+	}
+	return d
+}
+
+func (s *Supervisor) recordFailure(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+}
+
+func (s *Supervisor) clearFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = nil
+}
+
+// ringBuffer is a fixed-size, concurrency-safe byte buffer that keeps only
+// the most recently written bytes once it has filled up.
+type ringBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	max int
+}
+
+func newRingBuffer(max int) *ringBuffer {
+	return &ringBuffer{max: max}
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf.Write(p)
+	if over := r.buf.Len() - r.max; over > 0 {
+		r.buf.Next(over)
+	}
+	return len(p), nil
+}
+
+func (r *ringBuffer) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]byte, r.buf.Len())
+	copy(out, r.buf.Bytes())
+	return out
+}
+
+// PidfileMatches reports whether pidfile contains the decimal pid of a
+// still-alive process. It is useful as a Probe for children (like lisp-ztr)
+// that write their own pidfile.
+func PidfileMatches(pidfile string) error {
+	data, err := os.ReadFile(pidfile)
+	if err != nil {
+		return fmt.Errorf("reading pidfile %s: %w", pidfile, err)
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return fmt.Errorf("parsing pidfile %s: %w", pidfile, err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("pid %d from %s not found: %w", pid, pidfile, err)
+	}
+	// On Unix, FindProcess always succeeds; signal 0 checks liveness.
+	if err := proc.Signal(syscall.Signal(0)); err != nil {
+		return fmt.Errorf("pid %d from %s is not alive: %w", pid, pidfile, err)
+	}
+	return nil
+}
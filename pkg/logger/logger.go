@@ -0,0 +1,156 @@
+// Copyright (c) 2017 Zededa, Inc.
+// All rights reserved.
+
+// Package logger provides per-subsystem leveled logging in place of the
+// scattered `if debug { log.Printf(...) }` guards used throughout the
+// agents. Debug output is gated per area by the STTRACE environment
+// variable, a comma-separated list of area names (e.g. "STTRACE=lisp,net")
+// plus the special value "all". All output, regardless of level, is routed
+// through a single sink so it can be redirected to syslog or a file in one
+// place.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Sink is anything that can receive a fully formatted log line. The default
+// sink is the standard library's log package, writing to stderr.
+type Sink interface {
+	Output(level string, line string)
+}
+
+type stdSink struct{}
+
+func (stdSink) Output(level string, line string) {
+	log.Printf("%s %s", level, line)
+}
+
+var (
+	sinkMu      sync.Mutex
+	sink   Sink = stdSink{}
+)
+
+// SetSink redirects all subsequent log output to s. It is typically called
+// once at agent startup, e.g. to point at syslog.
+func SetSink(s Sink) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	sink = s
+}
+
+func output(level string, line string) {
+	sinkMu.Lock()
+	s := sink
+	sinkMu.Unlock()
+	s.Output(level, line)
+}
+
+// enabledAreas caches the parsed STTRACE environment variable: the set of
+// area names for which Debugf is active, plus an "all" catch-all.
+var (
+	areasOnce sync.Once
+	areas     map[string]bool
+	allAreas  bool
+)
+
+func loadAreas() {
+	areas = make(map[string]bool)
+	for _, a := range strings.Split(os.Getenv("STTRACE"), ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if a == "all" {
+			allAreas = true
+		}
+		areas[a] = true
+	}
+}
+
+func areaEnabled(name string) bool {
+	areasOnce.Do(loadAreas)
+	return allAreas || areas[name]
+}
+
+// Area returns whether the named subsystem has debug tracing enabled, per
+// STTRACE. Packages typically capture this once in a package-level var,
+// e.g. `var debugLisp = logger.Area("lisp")`, so each call site becomes a
+// zero-cost `if debugLisp { ... }` check.
+func Area(name string) bool {
+	return areaEnabled(name)
+}
+
+// Fields is structured key/value context attached to a log line, e.g. IID,
+// EID, ifname, so downstream log processors can filter without regex.
+type Fields map[string]interface{}
+
+// Logger is a per-subsystem logger. Debugf is a no-op unless the
+// constructing area is enabled via STTRACE.
+type Logger struct {
+	area   string
+	debug  bool
+	fields Fields
+}
+
+// New returns a Logger for the named area. Its Debugf calls are gated by
+// whether area is present in STTRACE (or STTRACE=all).
+func New(area string) *Logger {
+	return &Logger{area: area, debug: areaEnabled(area)}
+}
+
+// WithFields returns a copy of l with additional structured context merged
+// in; the original Logger is left unmodified.
+func (l *Logger) WithFields(f Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(f))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range f {
+		merged[k] = v
+	}
+	return &Logger{area: l.area, debug: l.debug, fields: merged}
+}
+
+func (l *Logger) format(format string, args ...interface{}) string {
+	msg := fmt.Sprintf(format, args...)
+	if len(l.fields) == 0 {
+		return fmt.Sprintf("[%s] %s", l.area, msg)
+	}
+	var kv strings.Builder
+	for k, v := range l.fields {
+		fmt.Fprintf(&kv, " %s=%v", k, v)
+	}
+	return fmt.Sprintf("[%s]%s %s", l.area, kv.String(), msg)
+}
+
+// Debugf logs at debug level; it costs nothing beyond the boolean check
+// when l's area is disabled.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if !l.debug {
+		return
+	}
+	output("DEBUG", l.format(format, args...))
+}
+
+// Infof logs at info level; always emitted regardless of STTRACE.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	output("INFO", l.format(format, args...))
+}
+
+// Warnf logs at warn level; always emitted regardless of STTRACE.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	output("WARN", l.format(format, args...))
+}
+
+// Errorf logs at error level; always emitted regardless of STTRACE. Unlike
+// log.Fatal, it never terminates the process — callers are expected to
+// return an error/degrade instead of crashing a field device over a
+// recoverable condition.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	output("ERROR", l.format(format, args...))
+}
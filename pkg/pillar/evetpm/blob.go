@@ -0,0 +1,204 @@
+// Copyright (c) 2020 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package evetpm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	fileutils "github.com/lf-edge/eve/pkg/pillar/utils/file"
+)
+
+// SealBlob seals data of arbitrary size under pcrSel, the same PCR policy
+// SealDiskKey uses. tpm2.Seal's data blob tops out around 128 bytes on many
+// devices, far too small for things like a kernel-command-line policy or an
+// enrolled per-app secret, so SealBlob hybrid-seals instead, the pattern
+// TPM2Tao's Seal/Unseal use: a fresh AES-256-GCM content key is generated
+// and used to encrypt data, only that 32-byte content key is sealed into
+// the TPM, and the ciphertext -- which can be arbitrarily large -- is
+// written alongside it to TpmSealedBlobCipherFileName on the persistent
+// partition.
+func SealBlob(data []byte, pcrSel tpm2.PCRSelection) error {
+	contentKey := make([]byte, blobContentKeyLength)
+	if _, err := rand.Read(contentKey); err != nil {
+		return fmt.Errorf("generating blob content key failed: %w", err)
+	}
+
+	ciphertext, err := sealGCM(contentKey, data)
+	if err != nil {
+		return fmt.Errorf("encrypting blob failed: %w", err)
+	}
+
+	if err := sealBlobContentKey(contentKey, pcrSel); err != nil {
+		return fmt.Errorf("sealing blob content key failed: %w", err)
+	}
+
+	if err := fileutils.WriteRename(TpmSealedBlobCipherFileName, ciphertext); err != nil {
+		return fmt.Errorf("writing sealed blob ciphertext failed: %w", err)
+	}
+	return nil
+}
+
+// UnsealBlob reverses SealBlob: it unseals the content key from the TPM
+// under pcrSel, then uses it to decrypt TpmSealedBlobCipherFileName.
+func UnsealBlob(pcrSel tpm2.PCRSelection) ([]byte, error) {
+	contentKey, err := unsealBlobContentKey(pcrSel)
+	if err != nil {
+		return nil, fmt.Errorf("unsealing blob content key failed: %w", err)
+	}
+
+	ciphertext, err := readSealedBlobCipher()
+	if err != nil {
+		return nil, fmt.Errorf("reading sealed blob ciphertext failed: %w", err)
+	}
+
+	data, err := openGCM(contentKey, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting blob failed: %w", err)
+	}
+	return data, nil
+}
+
+// sealGCM encrypts plaintext with a fresh random nonce under an
+// AES-256-GCM keyed by contentKey, returning nonce||ciphertext.
+func sealGCM(contentKey, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, fmt.Errorf("creating AES cipher failed: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating AES-GCM failed: %w", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce failed: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openGCM reverses sealGCM given nonce||ciphertext.
+func openGCM(contentKey, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, fmt.Errorf("creating AES cipher failed: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating AES-GCM failed: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed blob is shorter than a nonce")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func sealBlobContentKey(contentKey []byte, pcrSel tpm2.PCRSelection) error {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+
+	tpm2.NVUndefineSpace(rw, EmptyPassword,
+		tpm2.HandleOwner, TpmSealedBlobKeyPubHdl)
+
+	tpm2.NVUndefineSpace(rw, EmptyPassword,
+		tpm2.HandleOwner, TpmSealedBlobKeyPrivHdl)
+
+	session, policy, err := PolicyPCRSession(rw, pcrSel)
+	if err != nil {
+		return fmt.Errorf("PolicyPCRSession failed: %v", err)
+	}
+
+	//Don't need the handle, we need only the policy for sealing
+	if err := tpm2.FlushContext(rw, session); err != nil {
+		return fmt.Errorf("flushing session handle %v failed: %v", session, err)
+	}
+
+	priv, public, err := tpm2.Seal(rw, TpmSRKHdl, EmptyPassword, EmptyPassword, policy, contentKey)
+	if err != nil {
+		return fmt.Errorf("sealing the blob content key into TPM failed: %w", err)
+	}
+
+	if err := tpm2.NVDefineSpace(rw,
+		tpm2.HandleOwner,
+		TpmSealedBlobKeyPrivHdl,
+		EmptyPassword,
+		EmptyPassword,
+		nil,
+		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
+		uint16(len(priv)),
+	); err != nil {
+		return fmt.Errorf("NVDefineSpace %v failed: %v", TpmSealedBlobKeyPrivHdl, err)
+	}
+	if err := tpm2.NVWrite(rw, tpm2.HandleOwner, TpmSealedBlobKeyPrivHdl,
+		EmptyPassword, priv, 0); err != nil {
+		return fmt.Errorf("NVWrite %v failed: %v", TpmSealedBlobKeyPrivHdl, err)
+	}
+
+	if err := tpm2.NVDefineSpace(rw,
+		tpm2.HandleOwner,
+		TpmSealedBlobKeyPubHdl,
+		EmptyPassword,
+		EmptyPassword,
+		nil,
+		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
+		uint16(len(public)),
+	); err != nil {
+		return fmt.Errorf("NVDefineSpace %v failed: %v", TpmSealedBlobKeyPubHdl, err)
+	}
+	if err := tpm2.NVWrite(rw, tpm2.HandleOwner, TpmSealedBlobKeyPubHdl,
+		EmptyPassword, public, 0); err != nil {
+		return fmt.Errorf("NVWrite %v failed: %v", TpmSealedBlobKeyPubHdl, err)
+	}
+
+	return nil
+}
+
+func unsealBlobContentKey(pcrSel tpm2.PCRSelection) ([]byte, error) {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rw.Close()
+
+	priv, err := tpm2.NVReadEx(rw, TpmSealedBlobKeyPrivHdl,
+		tpm2.HandleOwner, EmptyPassword, 0)
+	if err != nil {
+		return nil, fmt.Errorf("NVReadEx %v failed: %v", TpmSealedBlobKeyPrivHdl, err)
+	}
+	pub, err := tpm2.NVReadEx(rw, TpmSealedBlobKeyPubHdl,
+		tpm2.HandleOwner, EmptyPassword, 0)
+	if err != nil {
+		return nil, fmt.Errorf("NVReadEx %v failed: %v", TpmSealedBlobKeyPubHdl, err)
+	}
+
+	sealedObjHandle, _, err := tpm2.Load(rw, TpmSRKHdl, "", pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("loading the blob content key into TPM failed: %w", err)
+	}
+	defer tpm2.FlushContext(rw, sealedObjHandle)
+
+	session, _, err := PolicyPCRSession(rw, pcrSel)
+	if err != nil {
+		return nil, fmt.Errorf("PolicyPCRSession failed: %v", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	key, err := tpm2.UnsealWithSession(rw, session, sealedObjHandle, EmptyPassword)
+	if err != nil {
+		return nil, fmt.Errorf("UnsealWithSession failed: %w", err)
+	}
+	return key, nil
+}
+
+func readSealedBlobCipher() ([]byte, error) {
+	return os.ReadFile(TpmSealedBlobCipherFileName)
+}
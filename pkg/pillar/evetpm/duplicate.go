@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package evetpm
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// duplicableSealTemplate describes a KEYEDHASH sealed object that may be
+// duplicated to newParentPolicy, the TPM2 equivalent of a TPM1.2 migration
+// blob: FixedTPM and FixedParent are left clear (the two attributes that,
+// when set, TPM2_Create would otherwise require by default, and that a
+// normal sealed object like TpmSealedDiskPrivHdl/PubHdl has), and
+// AdminWithPolicy plus an AuthPolicy of PolicyCommandCode(TPM2_CC_Duplicate)
+// mean the only admin action this object's owner can authorize is handing
+// it over to TPM2_Duplicate -- it can't, say, have its auth value changed.
+func duplicableSealTemplate(authPolicy []byte) tpm2.Public {
+	return tpm2.Public{
+		Type:       tpm2.AlgKeyedHash,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagAdminWithPolicy,
+		AuthPolicy: authPolicy,
+	}
+}
+
+// duplicationPolicy returns the AuthPolicy digest duplicableSealTemplate
+// needs: a trial session asserting nothing but PolicyCommandCode(Duplicate),
+// so TPM2_Duplicate is the one and only command this policy authorizes.
+func duplicationPolicy(rw io.ReadWriteCloser) ([]byte, error) {
+	session, _, err := tpm2.StartAuthSession(
+		rw,
+		tpm2.HandleNull,
+		tpm2.HandleNull,
+		make([]byte, 16),
+		nil,
+		tpm2.SessionTrial,
+		tpm2.AlgNull,
+		tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("StartAuthSession (trial) failed: %v", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	if err := tpm2.PolicyCommandCode(rw, session, tpm2.CmdDuplicate); err != nil {
+		return nil, fmt.Errorf("PolicyCommandCode(Duplicate) failed: %v", err)
+	}
+	return tpm2.PolicyGetDigest(rw, session)
+}
+
+// loadExternalParent loads newParentPub as an external, public-only TPM2
+// object, so it can stand in as TPM2_Duplicate's newParentHandle: TPM2
+// supports wrapping a duplicated object's sensitive area to an external
+// asymmetric public key this TPM never had the private half of, which is
+// exactly the "controller holds the new parent's private key offline"
+// model ExportSealedKey needs.
+func loadExternalParent(rw io.ReadWriteCloser, newParentPub crypto.PublicKey) (tpmutil.Handle, error) {
+	rsaPub, ok := newParentPub.(*rsa.PublicKey)
+	if !ok {
+		return tpm2.HandleNull, fmt.Errorf("newParentPub must be an *rsa.PublicKey, got %T", newParentPub)
+	}
+	template := tpm2.Public{
+		Type:    tpm2.AlgRSA,
+		NameAlg: tpm2.AlgSHA256,
+		Attributes: tpm2.FlagDecrypt | tpm2.FlagRestricted |
+			tpm2.FlagAdminWithPolicy,
+		RSAParameters: &tpm2.RSAParams{
+			Symmetric:  &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			KeyBits:    uint16(rsaPub.N.BitLen()),
+			ModulusRaw: rsaPub.N.Bytes(),
+		},
+	}
+	handle, _, err := tpm2.LoadExternal(rw, template, tpm2.Private{}, tpm2.HandleOwner)
+	if err != nil {
+		return tpm2.HandleNull, fmt.Errorf("LoadExternal (new parent) failed: %v", err)
+	}
+	return handle, nil
+}
+
+// ExportSealedKey is meant to wrap the current vault key for migration to
+// replacement hardware, analogous to the TPM1.2 authorizeMigrationKey/
+// createMigrationBlob flow but built on TPM2_Duplicate: unseal the vault
+// key from this device's TPM, reseal *that key* (not a fresh random
+// object) under a duplication policy via tpm2.Seal -- exactly the
+// caller-supplied-sensitive-data primitive SealDiskKey/SealDiskKeyWithCounter
+// already use -- duplicate it to newParentPub (a public key the controller
+// holds the private half of offline), and return the duplicate blob, its
+// encrypted inner seed, and the object's public area for ImportSealedKey to
+// bring the vault up on the replacement device.
+func ExportSealedKey(newParentPub crypto.PublicKey) (dupBlob, encSecret, pubArea []byte, err error) {
+	vaultKey, err := UnsealDiskKey(DiskKeySealingPCRs)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unsealing the current vault key failed: %w", err)
+	}
+
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rw.Close()
+
+	policy, err := duplicationPolicy(rw)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("duplicationPolicy failed: %w", err)
+	}
+
+	priv, pub, err := tpm2.Seal(rw, TpmSRKHdl, EmptyPassword, EmptyPassword, policy, vaultKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("sealing the vault key into a duplicable object failed: %w", err)
+	}
+
+	objHandle, _, err := tpm2.Load(rw, TpmSRKHdl, EmptyPassword, pub, priv)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("loading the duplicable object failed: %w", err)
+	}
+	defer tpm2.FlushContext(rw, objHandle)
+
+	newParentHandle, err := loadExternalParent(rw, newParentPub)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tpm2.FlushContext(rw, newParentHandle)
+
+	// The object's AuthPolicy only authorizes TPM2_Duplicate, so the
+	// session used to call it must assert exactly that, matching
+	// duplicationPolicy's trial session above.
+	session, _, err := tpm2.StartAuthSession(
+		rw,
+		tpm2.HandleNull,
+		tpm2.HandleNull,
+		make([]byte, 16),
+		nil,
+		tpm2.SessionPolicy,
+		tpm2.AlgNull,
+		tpm2.AlgSHA256)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("StartAuthSession (policy) failed: %v", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	if err := tpm2.PolicyCommandCode(rw, session, tpm2.CmdDuplicate); err != nil {
+		return nil, nil, nil, fmt.Errorf("PolicyCommandCode(Duplicate) failed: %v", err)
+	}
+
+	encSecret, dupBlob, err = tpm2.Duplicate(rw, session, objHandle, newParentHandle, nil, nil)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("TPM2_Duplicate failed: %w", err)
+	}
+	return dupBlob, encSecret, pub, nil
+}
+
+// ImportSealedKey is ExportSealedKey's counterpart, run on the replacement
+// device once it has the new parent's matching private key provisioned as
+// TpmSRKHdl (or another handle capable of TPM2_Import): it imports dupBlob/
+// encSecret/pubArea and stores the resulting private/public area under
+// TpmSealedDiskPrivHdl/TpmSealedDiskPubHdl, exactly where UnsealDiskKey
+// expects to find the vault's sealed disk key.
+func ImportSealedKey(dupBlob, encSecret, pubArea []byte) error {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+
+	priv, err := tpm2.Import(rw, TpmSRKHdl, EmptyPassword, pubArea, dupBlob, encSecret, nil, nil)
+	if err != nil {
+		return fmt.Errorf("TPM2_Import failed: %w", err)
+	}
+
+	return writeSealedDiskBlobs(rw, priv, pubArea)
+}
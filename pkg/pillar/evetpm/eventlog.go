@@ -0,0 +1,418 @@
+// Copyright (c) 2020 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package evetpm
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// TCG event-log algorithm IDs (TCG Algorithm Registry) this parser knows
+// how to size and name; the crypto-agile log format used on EVE's
+// supported platforms only ever measures into these banks.
+const (
+	algSHA1   uint16 = 0x0004
+	algSHA256 uint16 = 0x000B
+	algSHA384 uint16 = 0x000C
+	algSHA512 uint16 = 0x000D
+)
+
+var algNames = map[uint16]string{
+	algSHA1:   "sha1",
+	algSHA256: "sha256",
+	algSHA384: "sha384",
+	algSHA512: "sha512",
+}
+
+var algSizes = map[uint16]int{
+	algSHA1:   20,
+	algSHA256: 32,
+	algSHA384: 48,
+	algSHA512: 64,
+}
+
+var algHash = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// EventLogEntry is one parsed record from the TCG crypto-agile event log
+// (TCG PC Client Platform Firmware Profile, TCG_PCR_EVENT2), as found under
+// MeasurementLogSealSuccess/MeasurementLogUnsealFail.
+type EventLogEntry struct {
+	PCR int
+	// EventType is the TCG_EVENTTYPE of this record, e.g. EV_S_CRTM_VERSION
+	// or EV_EFI_BOOT_SERVICES_APPLICATION.
+	EventType uint32
+	// Digests maps algorithm name ("sha1", "sha256", "sha384", "sha512") to
+	// the digest this event extended that PCR's bank with.
+	Digests map[string][]byte
+	// Description is the event's raw, algorithm-independent event data.
+	Description []byte
+}
+
+// ParseEventLog walks a TCG crypto-agile event log and returns its entries
+// in order. The first entry is always the legacy-format TCG_PCR_EVENT "Spec
+// ID Event03" header (a single SHA1 digest, regardless of which banks the
+// rest of the log measures into); every entry after it is a
+// TCG_PCR_EVENT2 record carrying a TPML_DIGEST_VALUES, one digest per
+// active PCR bank.
+func ParseEventLog(data []byte) ([]EventLogEntry, error) {
+	r := bytes.NewReader(data)
+
+	header, err := parseLegacyEvent(r)
+	if err != nil {
+		return nil, fmt.Errorf("parsing event log header: %w", err)
+	}
+	entries := []EventLogEntry{header}
+
+	for r.Len() > 0 {
+		entry, err := parseEvent2(r)
+		if err != nil {
+			return nil, fmt.Errorf("parsing event log entry %d: %w", len(entries), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func parseLegacyEvent(r *bytes.Reader) (EventLogEntry, error) {
+	var pcr, eventType uint32
+	if err := binary.Read(r, binary.LittleEndian, &pcr); err != nil {
+		return EventLogEntry{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &eventType); err != nil {
+		return EventLogEntry{}, err
+	}
+	digest := make([]byte, algSizes[algSHA1])
+	if _, err := io.ReadFull(r, digest); err != nil {
+		return EventLogEntry{}, err
+	}
+	eventData, err := readEventData(r)
+	if err != nil {
+		return EventLogEntry{}, err
+	}
+	return EventLogEntry{
+		PCR:         int(pcr),
+		EventType:   eventType,
+		Digests:     map[string][]byte{algNames[algSHA1]: digest},
+		Description: eventData,
+	}, nil
+}
+
+func parseEvent2(r *bytes.Reader) (EventLogEntry, error) {
+	var pcr, eventType, count uint32
+	if err := binary.Read(r, binary.LittleEndian, &pcr); err != nil {
+		return EventLogEntry{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &eventType); err != nil {
+		return EventLogEntry{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return EventLogEntry{}, err
+	}
+
+	digests := make(map[string][]byte, count)
+	for i := uint32(0); i < count; i++ {
+		var algID uint16
+		if err := binary.Read(r, binary.LittleEndian, &algID); err != nil {
+			return EventLogEntry{}, err
+		}
+		size, ok := algSizes[algID]
+		if !ok {
+			return EventLogEntry{}, fmt.Errorf("unsupported digest algorithm %#x", algID)
+		}
+		digest := make([]byte, size)
+		if _, err := io.ReadFull(r, digest); err != nil {
+			return EventLogEntry{}, err
+		}
+		digests[algNames[algID]] = digest
+	}
+
+	eventData, err := readEventData(r)
+	if err != nil {
+		return EventLogEntry{}, err
+	}
+
+	return EventLogEntry{
+		PCR:         int(pcr),
+		EventType:   eventType,
+		Digests:     digests,
+		Description: eventData,
+	}, nil
+}
+
+func readEventData(r *bytes.Reader) ([]byte, error) {
+	var eventSize uint32
+	if err := binary.Read(r, binary.LittleEndian, &eventSize); err != nil {
+		return nil, err
+	}
+	eventData := make([]byte, eventSize)
+	if _, err := io.ReadFull(r, eventData); err != nil {
+		return nil, err
+	}
+	return eventData, nil
+}
+
+// ReplayPCRs extends entries into a shadow PCR bank exactly the way the TPM
+// extended its real PCRs while measuring them, using the digest algorithm
+// named by algo (e.g. "sha256"). Entries with no digest for algo (a log
+// captured while a different bank was active) are skipped.
+func ReplayPCRs(entries []EventLogEntry, algo string) map[int][]byte {
+	newHash := algHash[algo]
+	shadow := make(map[int][]byte)
+	if newHash == nil {
+		return shadow
+	}
+	for _, e := range entries {
+		digest, ok := e.Digests[algo]
+		if !ok {
+			continue
+		}
+		cur, ok := shadow[e.PCR]
+		if !ok {
+			cur = make([]byte, len(digest))
+		}
+		h := newHash()
+		h.Write(cur)
+		h.Write(digest)
+		shadow[e.PCR] = h.Sum(nil)
+	}
+	return shadow
+}
+
+// Quote is a TPM2 remote-attestation quote: the signed TPMS_ATTEST
+// structure binding a freshness nonce to pcrSel's values, plus the event
+// log entries GenerateQuote parsed at the same time, so a controller can
+// independently replay the log and check it reproduces the quoted PCR
+// values instead of having to trust them blindly.
+type Quote struct {
+	Attestation []byte
+	Signature   []byte
+	Log         []EventLogEntry
+}
+
+// GenerateQuote produces remote-attestation evidence using TpmQuoteKeyHdl:
+// a TPM2_Quote over pcrSel, signed and bound to nonce so the controller
+// knows the quote is fresh, alongside every parsed entry from this
+// platform's event log(s), the standard remote-attestation flow described
+// in the go-tpm-tools / TPM key-hierarchy guides.
+func GenerateQuote(nonce []byte, pcrSel tpm2.PCRSelection) (*Quote, error) {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rw.Close()
+
+	scheme := &tpm2.SigScheme{
+		Alg:  tpm2.AlgECDSA,
+		Hash: tpm2.AlgSHA256,
+	}
+	attestation, sig, err := tpm2.Quote(rw, TpmQuoteKeyHdl, EmptyPassword, EmptyPassword,
+		nonce, pcrSel, scheme)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_Quote failed: %w", err)
+	}
+
+	logPaths, err := getMeasurementLogFiles()
+	if err != nil {
+		return nil, fmt.Errorf("getMeasurementLogFiles failed: %w", err)
+	}
+	var log []EventLogEntry
+	for _, path := range logPaths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		entries, err := ParseEventLog(raw)
+		if err != nil {
+			continue
+		}
+		log = append(log, entries...)
+	}
+
+	return &Quote{Attestation: attestation, Signature: sig, Log: log}, nil
+}
+
+// sealingAlgoName returns the event-log bank name (e.g. "sha256") for
+// DiskKeySealingPCRs.Hash: TPM2_ALG_ID values are the TCG Algorithm Registry
+// IDs algNames is keyed by, so the live sealing bank always has an entry
+// here as long as it's one of the banks this package's event-log parser
+// understands.
+func sealingAlgoName() string {
+	return algNames[uint16(DiskKeySealingPCRs.Hash)]
+}
+
+// findMismatchingEvents compares the event log captured when the disk key
+// was last sealed (MeasurementLogSealSuccess) against the one captured on
+// this failed unseal (MeasurementLogUnsealFail), and returns the entries
+// for every PCR whose replayed value (in DiskKeySealingPCRs.Hash's bank)
+// differs between the two logs -- the exact events responsible for the PCR
+// policy no longer matching, rather than just the mismatching PCR index
+// findMismatchingPCRs reports.
+func findMismatchingEvents() ([]EventLogEntry, error) {
+	// Event logs are saved per TPM device, see copyMeasurementLog; this
+	// diagnostic only looks at the first one, same as findMismatchingPCRs
+	// only ever compares against a single saved PCR snapshot.
+	sealLog, err := loadEventLog(fmt.Sprintf(TpmEvtLogSavePattern, MeasurementLogSealSuccess, 0))
+	if err != nil {
+		return nil, fmt.Errorf("loading seal-time event log failed: %w", err)
+	}
+	failLog, err := loadEventLog(fmt.Sprintf(TpmEvtLogSavePattern, MeasurementLogUnsealFail, 0))
+	if err != nil {
+		return nil, fmt.Errorf("loading failed-unseal event log failed: %w", err)
+	}
+
+	algo := sealingAlgoName()
+	sealedPCRs := ReplayPCRs(sealLog, algo)
+	failedPCRs := ReplayPCRs(failLog, algo)
+
+	mismatchingPCRs := make(map[int]bool)
+	for pcr, sealedDigest := range sealedPCRs {
+		if !bytes.Equal(sealedDigest, failedPCRs[pcr]) {
+			mismatchingPCRs[pcr] = true
+		}
+	}
+
+	var events []EventLogEntry
+	for _, e := range failLog {
+		if mismatchingPCRs[e.PCR] {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func loadEventLog(path string) ([]EventLogEntry, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEventLog(raw)
+}
+
+// loadGobPCRs reads the shielded, gob-encoded sealedPCRSnapshot
+// saveDiskKeySealingPCRs writes to TpmSavedDiskSealingPcrs and returns its
+// PCR values, rejecting a snapshot taken under a bank other than
+// DiskKeySealingPCRs.Hash's current selection.
+func loadGobPCRs(path string) (map[int][]byte, error) {
+	raw, _, err := readShielded(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot sealedPCRSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Hash != DiskKeySealingPCRs.Hash {
+		return nil, fmt.Errorf("saved PCR snapshot bank %v does not match the live selected bank %v",
+			snapshot.Hash, DiskKeySealingPCRs.Hash)
+	}
+	return snapshot.PCRs, nil
+}
+
+// MismatchEvent is the event DiagnoseSealMismatch holds
+// responsible for a PCR no longer matching its value at seal time: the
+// last event that extended that PCR before the log ended, since it's the
+// one whose measurement produced the mismatching PCR's final value.
+type MismatchEvent struct {
+	PCR         int
+	EventType   uint32
+	Description []byte
+	// RunningDigest is this PCR's replayed value after this event.
+	RunningDigest []byte
+	// SealedDigest and LiveDigest are what the PCR held at seal time and
+	// holds now, respectively. The event is reported whenever these two
+	// differ; RunningDigest is not compared against either of them.
+	SealedDigest []byte
+	LiveDigest   []byte
+}
+
+// DiagnoseSealMismatch replays evtLogPath against sealedPCRsFile (the
+// shielded, gob-encoded sealedPCRSnapshot saveDiskKeySealingPCRs wrote at
+// seal time, see TpmSavedDiskSealingPcrs) and the live PCR bank, and for every PCR that no
+// longer matches its sealed value returns the last logged event that
+// extended it -- the firmware/bootloader/kernel change actually responsible,
+// rather than just the numeric PCR index findMismatchingPCRs reports.
+// Events for banks other than DiskKeySealingPCRs.Hash are skipped.
+//
+//nolint:dupl // mirrors ReplayPCRs' replay loop but also tracks lastEvent
+func DiagnoseSealMismatch(sealedPCRsFile, evtLogPath string) ([]MismatchEvent, error) {
+	sealedPCRs, err := loadGobPCRs(sealedPCRsFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading saved sealing PCRs failed: %w", err)
+	}
+	livePCRs, err := readDiskKeySealingPCRs()
+	if err != nil {
+		return nil, fmt.Errorf("reading live sealing PCRs failed: %w", err)
+	}
+
+	raw, err := os.ReadFile(evtLogPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading event log failed: %w", err)
+	}
+	entries, err := ParseEventLog(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing event log failed: %w", err)
+	}
+
+	algo := sealingAlgoName()
+	newHash := algHash[algo]
+	running := make(map[int][]byte)
+	lastEvent := make(map[int]EventLogEntry)
+	for _, e := range entries {
+		digest, ok := e.Digests[algo]
+		if !ok {
+			continue
+		}
+		cur, ok := running[e.PCR]
+		if !ok {
+			cur = make([]byte, len(digest))
+		}
+		h := newHash()
+		h.Write(cur)
+		h.Write(digest)
+		running[e.PCR] = h.Sum(nil)
+		lastEvent[e.PCR] = e
+	}
+
+	var mismatches []MismatchEvent
+	pcrs := make([]int, 0, len(running))
+	for pcr := range running {
+		pcrs = append(pcrs, pcr)
+	}
+	sort.Ints(pcrs)
+	for _, pcr := range pcrs {
+		replayed := running[pcr]
+		sealed := sealedPCRs[pcr]
+		live := livePCRs[pcr]
+		if bytes.Equal(sealed, live) {
+			continue
+		}
+		e := lastEvent[pcr]
+		mismatches = append(mismatches, MismatchEvent{
+			PCR:           pcr,
+			EventType:     e.EventType,
+			Description:   e.Description,
+			RunningDigest: replayed,
+			SealedDigest:  sealed,
+			LiveDigest:    live,
+		})
+	}
+	return mismatches, nil
+}
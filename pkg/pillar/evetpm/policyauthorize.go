@@ -0,0 +1,348 @@
+// Copyright (c) 2020 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package evetpm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	fileutils "github.com/lf-edge/eve/pkg/pillar/utils/file"
+)
+
+// tpmCCPolicyPCR is TPM_CC_PolicyPCR, the command code PolicyPCR's digest
+// update folds in; needed to compute a PolicyPCR digest for a PCR set the
+// live TPM doesn't currently hold (e.g. "PCR set after the upcoming
+// update"), which a trial session can't do since it can only assert PCRs
+// against whatever the TPM is holding right now.
+const tpmCCPolicyPCR = 0x0000017F
+
+// authorizedPCRApproval is one controller-signed PolicyPCR digest: "if the
+// live PCRs hash to PolicyDigest, Signature (over PolicyDigest, by the key
+// at TpmPolicyAuthKeyPubHdl) authorizes unsealing under it."
+type authorizedPCRApproval struct {
+	PolicyDigest []byte
+	Signature    []byte
+}
+
+// marshalPCRSelection encodes pcrSel as the single-bank TPML_PCR_SELECTION
+// PolicyPCR's digest calculation uses.
+func marshalPCRSelection(pcrSel tpm2.PCRSelection) []byte {
+	const sizeofSelect = 3 // covers PCR indexes 0-23, true of every DiskKeySealingPCRs user so far
+	bitmap := make([]byte, sizeofSelect)
+	for _, pcr := range pcrSel.PCRs {
+		bitmap[pcr/8] |= 1 << uint(pcr%8)
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(1)) // count: one TPMS_PCR_SELECTION
+	binary.Write(buf, binary.BigEndian, uint16(pcrSel.Hash))
+	buf.WriteByte(byte(sizeofSelect))
+	buf.Write(bitmap)
+	return buf.Bytes()
+}
+
+// computePolicyPCRDigest reproduces, in software, the policyDigest a trial
+// session's PolicyPCR(pcrSel) would produce against pcrValues, following
+// TPM2.0 Part 4's PolicyPCR: pcrDigest = H(pcr values in selection order),
+// policyDigestnew = H(policyDigestold=0 || CC_PolicyPCR || pcrSelection ||
+// pcrDigest). Unlike a real trial session this doesn't require the TPM to
+// actually hold pcrValues right now, so it can compute the digest for a
+// future, not-yet-applied PCR set (e.g. "PCR set after the upcoming
+// firmware update").
+func computePolicyPCRDigest(pcrSel tpm2.PCRSelection, pcrValues map[int][]byte) ([]byte, error) {
+	ph := sha256.New()
+	for _, pcr := range pcrSel.PCRs {
+		v, ok := pcrValues[pcr]
+		if !ok {
+			return nil, fmt.Errorf("missing value for PCR %d", pcr)
+		}
+		ph.Write(v)
+	}
+	pcrDigest := ph.Sum(nil)
+
+	h := sha256.New()
+	h.Write(make([]byte, sha256.Size))
+	var cc [4]byte
+	binary.BigEndian.PutUint32(cc[:], tpmCCPolicyPCR)
+	h.Write(cc[:])
+	h.Write(marshalPCRSelection(pcrSel))
+	h.Write(pcrDigest)
+	return h.Sum(nil), nil
+}
+
+// authorizedPolicyDigest is the AuthPolicy SealDiskKeyWithAuthorizedPolicy
+// seals the disk key under: a trial session's PolicyAuthorize(keyName,
+// policyRef). TPM2_PolicyAuthorize folds only keyName and policyRef into
+// the running policyDigest (the approvedPolicy/ticket arguments are only
+// checked, not hashed), so this digest is the same regardless of which PCR
+// set ends up being approved later -- it names the authorizing key, not a
+// PCR state.
+func authorizedPolicyDigest(rw io.ReadWriteCloser, keyName, policyRef []byte) ([]byte, error) {
+	session, _, err := tpm2.StartAuthSession(
+		rw,
+		tpm2.HandleNull,
+		tpm2.HandleNull,
+		make([]byte, 16),
+		nil,
+		tpm2.SessionTrial,
+		tpm2.AlgNull,
+		tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("StartAuthSession (trial) failed: %v", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	if err := tpm2.PolicyAuthorize(rw, session, nil, policyRef, keyName, tpm2.Ticket{}); err != nil {
+		return nil, fmt.Errorf("PolicyAuthorize failed: %v", err)
+	}
+	return tpm2.PolicyGetDigest(rw, session)
+}
+
+// loadAuthorizingKey loads pub, the EVE controller's PCR-approval signing
+// key, as an external, public-only TPM2 object, the public key never
+// having a TPM-resident private counterpart on this device; it returns the
+// handle and the object's Name, the latter being what
+// authorizedPolicyDigest/PolicyAuthorize identify the key by.
+func loadAuthorizingKey(rw io.ReadWriteCloser, pub *rsa.PublicKey) (tpmutil.Handle, []byte, error) {
+	template := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:       &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits:    uint16(pub.N.BitLen()),
+			ModulusRaw: pub.N.Bytes(),
+		},
+	}
+	handle, name, err := tpm2.LoadExternal(rw, template, tpm2.Private{}, tpm2.HandleOwner)
+	if err != nil {
+		return tpm2.HandleNull, nil, fmt.Errorf("LoadExternal (policy authorizing key) failed: %v", err)
+	}
+	return handle, name, nil
+}
+
+func persistAuthorizingKey(rw io.ReadWriteCloser, pub *rsa.PublicKey) error {
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmPolicyAuthKeyPubHdl)
+
+	modulus := pub.N.Bytes()
+	if err := tpm2.NVDefineSpace(rw,
+		tpm2.HandleOwner,
+		TpmPolicyAuthKeyPubHdl,
+		EmptyPassword,
+		EmptyPassword,
+		nil,
+		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
+		uint16(len(modulus)),
+	); err != nil {
+		return fmt.Errorf("NVDefineSpace %v failed: %v", TpmPolicyAuthKeyPubHdl, err)
+	}
+	if err := tpm2.NVWrite(rw, tpm2.HandleOwner, TpmPolicyAuthKeyPubHdl,
+		EmptyPassword, modulus, 0); err != nil {
+		return fmt.Errorf("NVWrite %v failed: %v", TpmPolicyAuthKeyPubHdl, err)
+	}
+	return nil
+}
+
+// readAuthorizingKey rebuilds the controller's public key from the modulus
+// persistAuthorizingKey saved; the exponent isn't persisted since every key
+// this package deals with uses the standard F4 exponent (65537).
+func readAuthorizingKey(rw io.ReadWriteCloser) (*rsa.PublicKey, error) {
+	modulus, err := tpm2.NVReadEx(rw, TpmPolicyAuthKeyPubHdl, tpm2.HandleOwner, EmptyPassword, 0)
+	if err != nil {
+		return nil, fmt.Errorf("NVReadEx %v failed: %v", TpmPolicyAuthKeyPubHdl, err)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: 65537}, nil
+}
+
+// SealDiskKeyWithAuthorizedPolicy seals key under TPM2_PolicyAuthorize(signerPub's
+// name) instead of a fixed PolicyPCR digest: signerPub is persisted to
+// TpmPolicyAuthKeyPubHdl so UnsealDiskKeyAuthorized can reload it later, and
+// the sealed object's policy only ever names that key, not any particular
+// PCR state. Any PCR set the controller later signs off on via
+// AddAuthorizedPCRSet -- including ones that don't exist yet, like "PCR
+// values after the upcoming GRUB update" -- can unseal this blob without a
+// reseal, fixing the brick-on-firmware-update problem PolicyPCRSession has.
+func SealDiskKeyWithAuthorizedPolicy(key []byte, signerPub *rsa.PublicKey) error {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+
+	if err := persistAuthorizingKey(rw, signerPub); err != nil {
+		return fmt.Errorf("persisting policy authorizing key failed: %w", err)
+	}
+
+	keyHandle, name, err := loadAuthorizingKey(rw, signerPub)
+	if err != nil {
+		return err
+	}
+	defer tpm2.FlushContext(rw, keyHandle)
+
+	policy, err := authorizedPolicyDigest(rw, name, nil)
+	if err != nil {
+		return fmt.Errorf("authorizedPolicyDigest failed: %w", err)
+	}
+
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmSealedDiskPubHdl)
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmSealedDiskPrivHdl)
+
+	priv, public, err := tpm2.Seal(rw, TpmSRKHdl, EmptyPassword, EmptyPassword, policy, key)
+	if err != nil {
+		return fmt.Errorf("sealing the disk key into TPM failed: %w", err)
+	}
+
+	return writeSealedDiskBlobs(rw, priv, public)
+}
+
+// AddAuthorizedPCRSet has the controller (via signer, typically backed by a
+// key held off-device) sign off on pcrs -- a full value for every PCR in
+// DiskKeySealingPCRs, whether the current set or an upcoming one -- and
+// appends the resulting approval to TpmAuthorizedPCRSetsFileName, so a
+// device sealed with SealDiskKeyWithAuthorizedPolicy can later unseal
+// against it via UnsealDiskKeyAuthorized without involving the TPM that
+// signed it.
+func AddAuthorizedPCRSet(pcrs map[int][]byte, signer crypto.Signer) error {
+	pcrIndexes := make([]int, 0, len(pcrs))
+	for pcr := range pcrs {
+		pcrIndexes = append(pcrIndexes, pcr)
+	}
+	sort.Ints(pcrIndexes)
+	pcrSel := tpm2.PCRSelection{Hash: DiskKeySealingPCRs.Hash, PCRs: pcrIndexes}
+
+	policyDigest, err := computePolicyPCRDigest(pcrSel, pcrs)
+	if err != nil {
+		return fmt.Errorf("computePolicyPCRDigest failed: %w", err)
+	}
+
+	sig, err := signer.Sign(rand.Reader, policyDigest, crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("signing approved PCR policy failed: %w", err)
+	}
+
+	approvals, _ := readAuthorizedPCRSets()
+	approvals = append(approvals, authorizedPCRApproval{PolicyDigest: policyDigest, Signature: sig})
+	return writeAuthorizedPCRSets(approvals)
+}
+
+func readAuthorizedPCRSets() ([]authorizedPCRApproval, error) {
+	f, err := os.Open(TpmAuthorizedPCRSetsFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var approvals []authorizedPCRApproval
+	if err := gob.NewDecoder(f).Decode(&approvals); err != nil {
+		return nil, err
+	}
+	return approvals, nil
+}
+
+func writeAuthorizedPCRSets(approvals []authorizedPCRApproval) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(approvals); err != nil {
+		return err
+	}
+	return fileutils.WriteRename(TpmAuthorizedPCRSetsFileName, buf.Bytes())
+}
+
+// UnsealDiskKeyAuthorized unseals the disk key sealed by
+// SealDiskKeyWithAuthorizedPolicy: it computes the live PCRs' PolicyPCR
+// digest, finds a matching controller-signed approval among
+// TpmAuthorizedPCRSetsFileName's entries, has the TPM verify that
+// signature (TPM2_VerifySignature) against the key persisted at
+// TpmPolicyAuthKeyPubHdl, and feeds the resulting ticket through
+// TPM2_PolicyAuthorize so the session's policy becomes the one the object
+// was actually sealed under, before unsealing.
+func UnsealDiskKeyAuthorized(pcrSel tpm2.PCRSelection) ([]byte, error) {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rw.Close()
+
+	livePCRs, err := readDiskKeySealingPCRs()
+	if err != nil {
+		return nil, fmt.Errorf("readDiskKeySealingPCRs failed: %w", err)
+	}
+	liveDigest, err := computePolicyPCRDigest(pcrSel, livePCRs)
+	if err != nil {
+		return nil, fmt.Errorf("computePolicyPCRDigest failed: %w", err)
+	}
+
+	approvals, err := readAuthorizedPCRSets()
+	if err != nil {
+		return nil, fmt.Errorf("reading authorized PCR sets failed: %w", err)
+	}
+	var approval *authorizedPCRApproval
+	for i := range approvals {
+		if bytes.Equal(approvals[i].PolicyDigest, liveDigest) {
+			approval = &approvals[i]
+			break
+		}
+	}
+	if approval == nil {
+		return nil, fmt.Errorf("no controller-signed approval matches the live PCR set")
+	}
+
+	signerPub, err := readAuthorizingKey(rw)
+	if err != nil {
+		return nil, fmt.Errorf("readAuthorizingKey failed: %w", err)
+	}
+	keyHandle, name, err := loadAuthorizingKey(rw, signerPub)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(rw, keyHandle)
+
+	sig := tpm2.Signature{
+		Alg: tpm2.AlgRSASSA,
+		RSA: &tpm2.SignatureRSA{HashAlg: tpm2.AlgSHA256, Signature: approval.Signature},
+	}
+	ticket, err := tpm2.VerifySignature(rw, keyHandle, liveDigest, &sig)
+	if err != nil {
+		return nil, fmt.Errorf("VerifySignature failed: %w", err)
+	}
+
+	priv, pub, err := readSealedDiskBlobs(rw)
+	if err != nil {
+		return nil, err
+	}
+	sealedObjHandle, _, err := tpm2.Load(rw, TpmSRKHdl, "", pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("loading the disk key into TPM failed: %w", err)
+	}
+	defer tpm2.FlushContext(rw, sealedObjHandle)
+
+	session, err := startSaltedPolicySession(rw)
+	if err != nil {
+		return nil, fmt.Errorf("starting policy session failed: %w", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	if err := tpm2.PolicyPCR(rw, session, nil, pcrSel); err != nil {
+		return nil, fmt.Errorf("PolicyPCR failed: %v", err)
+	}
+	if err := tpm2.PolicyAuthorize(rw, session, liveDigest, nil, name, *ticket); err != nil {
+		return nil, fmt.Errorf("PolicyAuthorize failed: %v", err)
+	}
+
+	key, err := tpm2.UnsealWithSession(rw, session, sealedObjHandle, EmptyPassword)
+	if err != nil {
+		return nil, fmt.Errorf("UnsealWithSession failed: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,340 @@
+// Copyright (c) 2020 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package evetpm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	fileutils "github.com/lf-edge/eve/pkg/pillar/utils/file"
+)
+
+// Quorum sealing: SealDiskKeyThreshold/UnsealDiskKeyThreshold Shamir-split
+// the disk key across every TPM getMappedTpmsPath enumerates, instead of
+// hard-coding TpmDevicePath, so a platform with a second discrete TPM or a
+// vTPM can survive losing (or PCR-desyncing) any n-k of its TPMs.
+const (
+	// TpmQuorumMetadataFileName persists the (k, n) threshold
+	// SealDiskKeyThreshold was last called with, so a later
+	// CompareLegacyandSealedKey doesn't need k handed back in separately.
+	TpmQuorumMetadataFileName = types.PersistStatusDir + "/tpm_quorum_threshold"
+)
+
+// quorumMetadata is TpmQuorumMetadataFileName's gob-encoded content.
+type quorumMetadata struct {
+	K int
+	N int
+}
+
+func saveQuorumMetadata(k, n int) error {
+	buff := new(bytes.Buffer)
+	if err := gob.NewEncoder(buff).Encode(quorumMetadata{K: k, N: n}); err != nil {
+		return fmt.Errorf("encoding quorum metadata failed: %w", err)
+	}
+	return fileutils.WriteRename(TpmQuorumMetadataFileName, buff.Bytes())
+}
+
+func readQuorumMetadata() (k int, n int, err error) {
+	b, err := os.ReadFile(TpmQuorumMetadataFileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	var m quorumMetadata
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&m); err != nil {
+		return 0, 0, err
+	}
+	return m.K, m.N, nil
+}
+
+// SealDiskKeyThreshold Shamir-splits key into n shares, with any k of them
+// sufficient to reconstruct it, and seals share i into the i'th TPM
+// getMappedTpmsPath enumerates (each under its own PolicyPCRSession against
+// that TPM's own PCR bank).
+func SealDiskKeyThreshold(key []byte, k, n int) error {
+	paths, err := getMappedTpmsPath()
+	if err != nil {
+		return fmt.Errorf("getMappedTpmsPath failed: %w", err)
+	}
+	if len(paths) < n {
+		return fmt.Errorf("requested %d-of-%d sealing but only %d TPM(s) are mapped", k, n, len(paths))
+	}
+
+	shares, err := splitSecret(key, k, n)
+	if err != nil {
+		return fmt.Errorf("splitting disk key into %d-of-%d shares failed: %w", k, n, err)
+	}
+
+	for i, share := range shares {
+		devicePath, err := tpmDevicePathForSysfsPath(paths[i])
+		if err != nil {
+			return fmt.Errorf("resolving device path for share %d failed: %w", i, err)
+		}
+		if err := sealShareToTpm(devicePath, share); err != nil {
+			return fmt.Errorf("sealing share %d into %s failed: %w", i, devicePath, err)
+		}
+	}
+
+	if err := saveDiskKeySealingPCRs(TpmSavedDiskSealingPcrs); err != nil {
+		return fmt.Errorf("saving snapshot of sealing PCRs failed: %w", err)
+	}
+	if err := backupCopiedMeasurementLogs(); err != nil {
+		return fmt.Errorf("collecting previous snapshot of TPM event log failed: %w", err)
+	}
+	if err := removeCopiedMeasurementLogs(); err != nil {
+		return fmt.Errorf("removing old copies of TPM measurement log failed: %w", err)
+	}
+	if err := copyMeasurementLog(MeasurementLogSealSuccess); err != nil {
+		return fmt.Errorf("copying current TPM measurement log failed: %w", err)
+	}
+
+	if err := saveQuorumMetadata(k, n); err != nil {
+		return fmt.Errorf("saving quorum threshold metadata failed: %w", err)
+	}
+	return nil
+}
+
+// sealShareToTpm seals one Shamir share into the TPM at devicePath, the
+// same way SealDiskKey seals the monolithic key into TpmDevicePath.
+func sealShareToTpm(devicePath string, share []byte) error {
+	rw, err := tpm2.OpenTPM(devicePath)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmSealedDiskPubHdl)
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmSealedDiskPrivHdl)
+
+	session, policy, err := PolicyPCRSession(rw, DiskKeySealingPCRs)
+	if err != nil {
+		return fmt.Errorf("PolicyPCRSession failed: %w", err)
+	}
+	if err := tpm2.FlushContext(rw, session); err != nil {
+		return fmt.Errorf("flushing session handle %v failed: %w", session, err)
+	}
+
+	priv, public, err := tpm2.Seal(rw, TpmSRKHdl, EmptyPassword, EmptyPassword, policy, share)
+	if err != nil {
+		return fmt.Errorf("sealing share failed: %w", err)
+	}
+
+	return writeSealedDiskBlobs(rw, priv, public)
+}
+
+// thresholdShare is one (x-coordinate, share bytes) pair recovered by
+// UnsealDiskKeyThreshold, x being the mapped TPM's 1-indexed position.
+type thresholdShare struct {
+	x     byte
+	share []byte
+}
+
+// UnsealDiskKeyThreshold opens every TPM getMappedTpmsPath enumerates in
+// parallel, attempts to unseal its SealDiskKeyThreshold share, and
+// reconstructs the original key as soon as k of them succeed.
+func UnsealDiskKeyThreshold(k int) ([]byte, error) {
+	paths, err := getMappedTpmsPath()
+	if err != nil {
+		return nil, fmt.Errorf("getMappedTpmsPath failed: %w", err)
+	}
+
+	results := make(chan thresholdShare, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			devicePath, err := tpmDevicePathForSysfsPath(path)
+			if err != nil {
+				return
+			}
+			share, err := unsealShareFromTpm(devicePath)
+			if err != nil {
+				return
+			}
+			results <- thresholdShare{x: byte(i + 1), share: share}
+		}(i, path)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var xs []byte
+	var shares [][]byte
+	for r := range results {
+		xs = append(xs, r.x)
+		shares = append(shares, r.share)
+		if len(xs) >= k {
+			break
+		}
+	}
+	if len(xs) < k {
+		return nil, fmt.Errorf("only %d of the required %d TPM shares could be unsealed", len(xs), k)
+	}
+
+	return reconstructSecret(xs, shares)
+}
+
+// unsealShareFromTpm unseals one share the same way UnsealDiskKey unseals
+// the monolithic key, against whichever TPM devicePath names.
+func unsealShareFromTpm(devicePath string) ([]byte, error) {
+	rw, err := tpm2.OpenTPM(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rw.Close()
+
+	priv, pub, err := readSealedDiskBlobs(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedObjHandle, _, err := tpm2.Load(rw, TpmSRKHdl, "", pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("loading share into TPM failed: %w", err)
+	}
+	defer tpm2.FlushContext(rw, sealedObjHandle)
+
+	session, _, err := PolicyPCRSession(rw, DiskKeySealingPCRs)
+	if err != nil {
+		return nil, fmt.Errorf("PolicyPCRSession failed: %w", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	return tpm2.UnsealWithSession(rw, session, sealedObjHandle, EmptyPassword)
+}
+
+// --- GF(256) Shamir secret sharing, one independent polynomial per byte ---
+
+var (
+	gf256Exp [512]byte
+	gf256Log [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gf256Exp[i] = x
+		gf256Log[x] = byte(i)
+		x = gf256MulNoTable(x, 0x03)
+	}
+	for i := 255; i < 512; i++ {
+		gf256Exp[i] = gf256Exp[i-255]
+	}
+}
+
+// gf256MulNoTable multiplies in GF(2^8) modulo the AES reducing polynomial
+// x^8+x^4+x^3+x+1 (0x11B), used only to bootstrap the log/exp tables above.
+func gf256MulNoTable(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		if b&1 != 0 {
+			p ^= a
+		}
+		hiBitSet := a&0x80 != 0
+		a <<= 1
+		if hiBitSet {
+			a ^= 0x1B
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func gf256Mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf256Exp[int(gf256Log[a])+int(gf256Log[b])]
+}
+
+func gf256Div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gf256Exp[(int(gf256Log[a])-int(gf256Log[b])+255)%255]
+}
+
+// gf256EvalPoly evaluates a GF(256) polynomial, coeffs[0] the constant term
+// (the secret byte), at x via Horner's method.
+func gf256EvalPoly(coeffs []byte, x byte) byte {
+	var result byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		result = gf256Mul(result, x) ^ coeffs[i]
+	}
+	return result
+}
+
+// gf256Interpolate returns a Shamir polynomial's value at x=0 (the secret
+// byte) via Lagrange interpolation through the given (xs[i], ys[i]) points.
+func gf256Interpolate(xs, ys []byte) byte {
+	var result byte
+	for i := range xs {
+		num := byte(1)
+		den := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			num = gf256Mul(num, xs[j])
+			den = gf256Mul(den, xs[i]^xs[j])
+		}
+		result ^= gf256Mul(ys[i], gf256Div(num, den))
+	}
+	return result
+}
+
+// splitSecret Shamir-splits secret into n shares of the same length, any k
+// of which reconstruct it, evaluating one random degree-(k-1) polynomial
+// per byte at x = 1..n.
+func splitSecret(secret []byte, k, n int) ([][]byte, error) {
+	if k < 1 || n < k || n > 255 {
+		return nil, fmt.Errorf("invalid threshold parameters k=%d n=%d", k, n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+
+	coeffs := make([]byte, k)
+	for b, secretByte := range secret {
+		coeffs[0] = secretByte
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, fmt.Errorf("generating random polynomial coefficients failed: %w", err)
+		}
+		for x := 1; x <= n; x++ {
+			shares[x-1][b] = gf256EvalPoly(coeffs, byte(x))
+		}
+	}
+	return shares, nil
+}
+
+// reconstructSecret reverses splitSecret given k (x, share) pairs, xs[i]
+// being the x-coordinate shares[i] was evaluated at.
+func reconstructSecret(xs []byte, shares [][]byte) ([]byte, error) {
+	if len(xs) != len(shares) || len(xs) == 0 {
+		return nil, fmt.Errorf("reconstructSecret needs matching non-empty xs/shares")
+	}
+
+	secretLen := len(shares[0])
+	secret := make([]byte, secretLen)
+	ys := make([]byte, len(shares))
+	for b := 0; b < secretLen; b++ {
+		for i, s := range shares {
+			if len(s) != secretLen {
+				return nil, fmt.Errorf("share %d has mismatched length %d, want %d", i, len(s), secretLen)
+			}
+			ys[i] = s[b]
+		}
+		secret[b] = gf256Interpolate(xs, ys)
+	}
+	return secret, nil
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2020 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package evetpm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	fileutils "github.com/lf-edge/eve/pkg/pillar/utils/file"
+)
+
+// PolicyPCRCounterSession prepares a TPM2 Auth Policy session whose policy
+// is PolicyPCR(pcrSel) && PolicyNV(TpmVaultPolicyCounterHdl == counterValue),
+// mirroring snapd secboot's RunObjectPCRPolicyCounterHandle scheme. PCR-only
+// sealing (PolicyPCRSession) can't distinguish the current sealed blob from
+// an older one restored from a backup; binding the policy to the exact value
+// TpmVaultPolicyCounterHdl held at seal time, rather than a lower bound, is
+// what lets RevokeSealedKey cut that backup off.
+//
+// The comparison must be exact equality, not >=: the counter only grows, so
+// an older stamp's ">=" comparison would stay satisfiable forever, and an
+// old blob restored from a backup would keep unsealing successfully even
+// after RevokeSealedKey increments the live counter -- making revocation a
+// no-op. With "==", RevokeSealedKey's increment alone is enough to strand
+// every blob stamped with a counter value below the new one; a legitimate
+// reseal (e.g. SealDiskKeyWithCounter run again after a firmware update
+// changes the sealing PCRs) simply reseals against the current counter
+// value and gets its own exact-match policy.
+func PolicyPCRCounterSession(rw io.ReadWriteCloser, pcrSel tpm2.PCRSelection, counterValue uint64) (tpmutil.Handle, []byte, error) {
+	session, err := startSaltedPolicySession(rw)
+	if err != nil {
+		return tpm2.HandleNull, nil, err
+	}
+	defer func() {
+		if session != tpm2.HandleNull && err != nil {
+			tpm2.FlushContext(rw, session)
+		}
+	}()
+
+	if err = tpm2.PolicyPCR(rw, session, nil, pcrSel); err != nil {
+		return session, nil, fmt.Errorf("PolicyPCR failed: %v", err)
+	}
+
+	operand := make([]byte, 8)
+	binary.BigEndian.PutUint64(operand, counterValue)
+	if err = tpm2.PolicyNV(rw, tpm2.HandleOwner, TpmVaultPolicyCounterHdl, session,
+		operand, 0, tpm2.OpEq); err != nil {
+		return session, nil, fmt.Errorf("PolicyNV failed: %v", err)
+	}
+
+	policy, err := tpm2.PolicyGetDigest(rw, session)
+	if err != nil {
+		return session, nil, fmt.Errorf("PolicyGetDigest failed: %w", err)
+	}
+	return session, policy, nil
+}
+
+// ensureVaultPolicyCounter defines TpmVaultPolicyCounterHdl as an NV counter
+// the first time it's needed, and gives it an initial value of 1 so
+// readVaultPolicyCounter never has to special-case a freshly defined,
+// never-incremented counter.
+func ensureVaultPolicyCounter(rw io.ReadWriteCloser) error {
+	if _, err := readVaultPolicyCounter(rw); err == nil {
+		return nil
+	}
+
+	//not an error if it fails
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmVaultPolicyCounterHdl)
+
+	if err := tpm2.NVDefineSpace(rw,
+		tpm2.HandleOwner,
+		TpmVaultPolicyCounterHdl,
+		EmptyPassword,
+		EmptyPassword,
+		nil,
+		tpm2.AttrCounter|tpm2.AttrPolicyWrite|tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
+		8,
+	); err != nil {
+		return fmt.Errorf("NVDefineSpace %v failed: %v", TpmVaultPolicyCounterHdl, err)
+	}
+	if err := tpm2.NVIncrement(rw, tpm2.HandleOwner, TpmVaultPolicyCounterHdl, EmptyPassword); err != nil {
+		return fmt.Errorf("NVIncrement %v (initial) failed: %v", TpmVaultPolicyCounterHdl, err)
+	}
+	return nil
+}
+
+func readVaultPolicyCounter(rw io.ReadWriteCloser) (uint64, error) {
+	b, err := tpm2.NVReadEx(rw, TpmVaultPolicyCounterHdl, tpm2.HandleOwner, EmptyPassword, 0)
+	if err != nil {
+		return 0, fmt.Errorf("NVReadEx %v failed: %v", TpmVaultPolicyCounterHdl, err)
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("unexpected NV counter size %d for %v", len(b), TpmVaultPolicyCounterHdl)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func writeVaultPolicyCounterStamp(counterValue uint64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, counterValue)
+	return fileutils.WriteRename(TpmVaultPolicyCounterStampFileName, b)
+}
+
+func readVaultPolicyCounterStamp() (uint64, error) {
+	b, err := os.ReadFile(TpmVaultPolicyCounterStampFileName)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("unexpected counter stamp size %d", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// SealDiskKeyWithCounter is SealDiskKey with the vault seal policy
+// additionally bound to TpmVaultPolicyCounterHdl, for anti-rollback.
+func SealDiskKeyWithCounter(key []byte, pcrSel tpm2.PCRSelection) error {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+
+	if err := ensureVaultPolicyCounter(rw); err != nil {
+		return fmt.Errorf("ensureVaultPolicyCounter failed: %w", err)
+	}
+	counterValue, err := readVaultPolicyCounter(rw)
+	if err != nil {
+		return fmt.Errorf("readVaultPolicyCounter failed: %w", err)
+	}
+
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmSealedDiskPubHdl)
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmSealedDiskPrivHdl)
+
+	session, policy, err := PolicyPCRCounterSession(rw, pcrSel, counterValue)
+	if err != nil {
+		return fmt.Errorf("PolicyPCRCounterSession failed: %v", err)
+	}
+	if err := tpm2.FlushContext(rw, session); err != nil {
+		return fmt.Errorf("flushing session handle %v failed: %v", session, err)
+	}
+
+	priv, public, err := tpm2.Seal(rw, TpmSRKHdl, EmptyPassword, EmptyPassword, policy, key)
+	if err != nil {
+		return fmt.Errorf("sealing the disk key into TPM failed: %w", err)
+	}
+
+	if err := writeSealedDiskBlobs(rw, priv, public); err != nil {
+		return err
+	}
+
+	if err := saveDiskKeySealingPCRs(TpmSavedDiskSealingPcrs); err != nil {
+		return fmt.Errorf("saving snapshot of sealing PCRs failed: %w", err)
+	}
+	if err := writeVaultPolicyCounterStamp(counterValue); err != nil {
+		return fmt.Errorf("stamping vault policy counter failed: %w", err)
+	}
+
+	return nil
+}
+
+// UnsealDiskKeyWithCounter is UnsealDiskKey with the vault seal policy
+// additionally bound to TpmVaultPolicyCounterHdl; it loads the counter
+// value stamped by SealDiskKeyWithCounter to rebuild the same compound
+// policy the blob was sealed under.
+func UnsealDiskKeyWithCounter(pcrSel tpm2.PCRSelection) ([]byte, error) {
+	counterValue, err := readVaultPolicyCounterStamp()
+	if err != nil {
+		return nil, fmt.Errorf("reading vault policy counter stamp failed: %w", err)
+	}
+
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rw.Close()
+
+	priv, pub, err := readSealedDiskBlobs(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedObjHandle, _, err := tpm2.Load(rw, TpmSRKHdl, "", pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("loading the disk key into TPM failed: %w", err)
+	}
+	defer tpm2.FlushContext(rw, sealedObjHandle)
+
+	session, _, err := PolicyPCRCounterSession(rw, pcrSel, counterValue)
+	if err != nil {
+		return nil, fmt.Errorf("PolicyPCRCounterSession failed: %v", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	key, err := tpm2.UnsealWithSession(rw, session, sealedObjHandle, EmptyPassword)
+	if err != nil {
+		return nil, fmt.Errorf("UnsealWithSession failed: %w", err)
+	}
+	return key, nil
+}
+
+// RevokeSealedKey increments TpmVaultPolicyCounterHdl and deletes the sealed
+// disk key and its counter stamp, so no copy of the sealed blob -- including
+// one restored from a backup taken before the revocation -- can be unsealed
+// afterward: UnsealDiskKeyWithCounter has no stamp left to rebuild the
+// policy from, and SealDiskKeyWithCounter must be run again, producing a
+// blob stamped with the new counter value, before the vault is usable
+// again. Call it on factory reset, deliberate key rotation, or after a
+// suspected compromise of the sealed blob.
+func RevokeSealedKey() error {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+
+	if err := ensureVaultPolicyCounter(rw); err != nil {
+		return fmt.Errorf("ensureVaultPolicyCounter failed: %w", err)
+	}
+	if err := tpm2.NVIncrement(rw, tpm2.HandleOwner, TpmVaultPolicyCounterHdl, EmptyPassword); err != nil {
+		return fmt.Errorf("NVIncrement %v failed: %v", TpmVaultPolicyCounterHdl, err)
+	}
+
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmSealedDiskPubHdl)
+	tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, TpmSealedDiskPrivHdl)
+	// readShieldedNV would otherwise rebuild the blobs from these
+	for _, hdl := range []tpmutil.Handle{TpmSealedDiskPubMirrorHdl, TpmSealedDiskPubParityHdl,
+		TpmSealedDiskPrivMirrorHdl, TpmSealedDiskPrivParityHdl} {
+		tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, hdl)
+	}
+	_ = os.Remove(TpmVaultPolicyCounterStampFileName)
+
+	return nil
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2020 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package evetpm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/HACKERALERT/infectious"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	fileutils "github.com/lf-edge/eve/pkg/pillar/utils/file"
+)
+
+// Reed-Solomon shielding for the sealed-vault blobs EVE writes to disk,
+// the same shard-and-parity approach Picocrypt uses (and the same
+// underlying library): a single bit flip on the persistent partition, in
+// either the NV-mirrored priv/pub blobs or the saved PCR snapshot, would
+// otherwise brick the vault permanently since there's no other copy to
+// fall back to.
+const (
+	// shieldShardSize is the size, in bytes, of each data shard a chunk is
+	// split into before encoding.
+	shieldShardSize = 128
+
+	// shieldRequiredShards/shieldTotalShards make this a (255,128)
+	// Reed-Solomon code: any 128 of the 255 shards per chunk, in any
+	// combination of data and parity shards, are enough to reconstruct it.
+	shieldRequiredShards = 128
+	shieldTotalShards    = 255
+
+	shieldChunkSize = shieldRequiredShards * shieldShardSize
+
+	shieldMagic = "RSV1"
+)
+
+// writeShielded Reed-Solomon encodes data in shieldChunkSize chunks and
+// writes every chunk's shieldTotalShards shards, each CRC32-tagged so
+// readShielded can detect and drop a corrupted one, to path.
+func writeShielded(path string, data []byte) error {
+	fec, err := infectious.NewFEC(shieldRequiredShards, shieldTotalShards)
+	if err != nil {
+		return fmt.Errorf("infectious.NewFEC failed: %w", err)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(shieldMagic)
+
+	var lenBuf [8]byte
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(len(data)))
+	buf.Write(lenBuf[:])
+
+	numChunks := (len(data) + shieldChunkSize - 1) / shieldChunkSize
+	if numChunks == 0 {
+		numChunks = 1
+	}
+	var numBuf [4]byte
+	binary.BigEndian.PutUint32(numBuf[:], uint32(numChunks))
+	buf.Write(numBuf[:])
+
+	for i := 0; i < numChunks; i++ {
+		start := i * shieldChunkSize
+		end := start + shieldChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, shieldChunkSize)
+		copy(chunk, data[start:end])
+
+		shares := make([]infectious.Share, 0, shieldTotalShards)
+		if err := fec.Encode(chunk, func(s infectious.Share) {
+			cp := make([]byte, len(s.Data))
+			copy(cp, s.Data)
+			shares = append(shares, infectious.Share{Number: s.Number, Data: cp})
+		}); err != nil {
+			return fmt.Errorf("encoding shield chunk %d failed: %w", i, err)
+		}
+
+		for _, s := range shares {
+			var crcBuf [4]byte
+			binary.BigEndian.PutUint32(crcBuf[:], crc32.ChecksumIEEE(s.Data))
+			buf.Write(crcBuf[:])
+			buf.Write(s.Data)
+		}
+	}
+
+	return fileutils.WriteRename(path, buf.Bytes())
+}
+
+// readShielded reverses writeShielded. The second return value reports
+// whether any shard was found corrupted and had to be reconstructed from
+// the rest of its chunk's shards -- callers should log this so operators
+// know to replace the medium before shards run out.
+func readShielded(path string) ([]byte, bool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	r := bytes.NewReader(raw)
+
+	magic := make([]byte, len(shieldMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != shieldMagic {
+		return nil, false, fmt.Errorf("%s is not a shielded file (bad magic)", path)
+	}
+
+	var lenBuf [8]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, false, err
+	}
+	dataLen := binary.BigEndian.Uint64(lenBuf[:])
+
+	var numBuf [4]byte
+	if _, err := io.ReadFull(r, numBuf[:]); err != nil {
+		return nil, false, err
+	}
+	numChunks := binary.BigEndian.Uint32(numBuf[:])
+
+	fec, err := infectious.NewFEC(shieldRequiredShards, shieldTotalShards)
+	if err != nil {
+		return nil, false, fmt.Errorf("infectious.NewFEC failed: %w", err)
+	}
+
+	out := new(bytes.Buffer)
+	repaired := false
+	for i := uint32(0); i < numChunks; i++ {
+		shares := make([]infectious.Share, 0, shieldTotalShards)
+		for n := 0; n < shieldTotalShards; n++ {
+			var crcBuf [4]byte
+			if _, err := io.ReadFull(r, crcBuf[:]); err != nil {
+				return nil, repaired, err
+			}
+			shardData := make([]byte, shieldShardSize)
+			if _, err := io.ReadFull(r, shardData); err != nil {
+				return nil, repaired, err
+			}
+			if crc32.ChecksumIEEE(shardData) != binary.BigEndian.Uint32(crcBuf[:]) {
+				// drop the corrupted shard; the RS code reconstructs the
+				// chunk from the remaining shards below.
+				repaired = true
+				continue
+			}
+			shares = append(shares, infectious.Share{Number: n, Data: shardData})
+		}
+		if len(shares) < shieldRequiredShards {
+			return nil, repaired, fmt.Errorf("shield chunk %d has only %d intact shards, need %d",
+				i, len(shares), shieldRequiredShards)
+		}
+
+		chunk, err := fec.Decode(nil, shares)
+		if err != nil {
+			return nil, repaired, fmt.Errorf("decoding shield chunk %d failed: %w", i, err)
+		}
+		out.Write(chunk)
+	}
+
+	data := out.Bytes()
+	if uint64(len(data)) < dataLen {
+		return nil, repaired, fmt.Errorf("%s: reconstructed data shorter than recorded length", path)
+	}
+	return data[:dataLen], repaired, nil
+}
+
+// writeShieldedNV is the NV-storage equivalent of writeShielded: a TPM
+// sealed priv/public blob is too small to usefully shard into 128-byte
+// Reed-Solomon pieces (see writeDiskKey), so it gets the same split-plus-
+// parity protection writeDiskKey already gives the legacy disk key instead,
+// spread across hdl/mirrorHdl/parityHdl, so the sealed blob survives one
+// of the three NV indices becoming unreadable. readShieldedNV uses the
+// parity only when a read fails; a flipped bit in an index that still
+// reads back is not detected.
+func writeShieldedNV(rw io.ReadWriteCloser, hdl, mirrorHdl, parityHdl tpmutil.Handle, data []byte) error {
+	buf := make([]byte, 8, 8+len(data)+1)
+	binary.BigEndian.PutUint64(buf, uint64(len(data)))
+	buf = append(buf, data...)
+	if len(buf)%2 != 0 {
+		buf = append(buf, 0)
+	}
+
+	half := len(buf) / 2
+	first, second := buf[:half], buf[half:]
+	parity := xorBytes(first, second)
+
+	for _, nv := range []struct {
+		hdl  tpmutil.Handle
+		data []byte
+	}{
+		{hdl, first},
+		{mirrorHdl, second},
+		{parityHdl, parity},
+	} {
+		//not an error if it fails
+		tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, nv.hdl)
+
+		if err := tpm2.NVDefineSpace(rw,
+			tpm2.HandleOwner,
+			nv.hdl,
+			EmptyPassword,
+			EmptyPassword,
+			nil,
+			tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
+			uint16(len(nv.data)),
+		); err != nil {
+			return fmt.Errorf("NVDefineSpace %v failed: %v", nv.hdl, err)
+		}
+
+		if err := tpm2.NVWrite(rw, tpm2.HandleOwner, nv.hdl,
+			EmptyPassword, nv.data, 0); err != nil {
+			return fmt.Errorf("NVWrite %v failed: %v", nv.hdl, err)
+		}
+	}
+	return nil
+}
+
+// readShieldedNV reverses writeShieldedNV, reconstructing the shielded half
+// from the parity NV index if either hdl or mirrorHdl can no longer be read.
+func readShieldedNV(rw io.ReadWriteCloser, hdl, mirrorHdl, parityHdl tpmutil.Handle) ([]byte, error) {
+	first, firstErr := tpm2.NVReadEx(rw, hdl, tpm2.HandleOwner, EmptyPassword, 0)
+	second, secondErr := tpm2.NVReadEx(rw, mirrorHdl, tpm2.HandleOwner, EmptyPassword, 0)
+
+	if firstErr != nil || secondErr != nil {
+		parity, parityErr := tpm2.NVReadEx(rw, parityHdl, tpm2.HandleOwner, EmptyPassword, 0)
+		if parityErr != nil {
+			if firstErr != nil {
+				return nil, fmt.Errorf("NVReadEx %v failed: %v", hdl, firstErr)
+			}
+			return nil, fmt.Errorf("NVReadEx %v failed: %v", mirrorHdl, secondErr)
+		}
+		switch {
+		case firstErr != nil && secondErr == nil:
+			fmt.Fprintf(os.Stderr, "%v: reconstructed from parity, medium may be failing and should be replaced\n", hdl)
+			first = xorBytes(parity, second)
+		case secondErr != nil && firstErr == nil:
+			fmt.Fprintf(os.Stderr, "%v: reconstructed from parity, medium may be failing and should be replaced\n", mirrorHdl)
+			second = xorBytes(parity, first)
+		default:
+			return nil, fmt.Errorf("NVReadEx failed: %v, %v", firstErr, secondErr)
+		}
+	}
+
+	buf := append(append([]byte{}, first...), second...)
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("shielded NV data shorter than its length header")
+	}
+	dataLen := binary.BigEndian.Uint64(buf[:8])
+	rest := buf[8:]
+	if uint64(len(rest)) < dataLen {
+		return nil, fmt.Errorf("shielded NV data shorter than recorded length")
+	}
+	return rest[:dataLen], nil
+}
+
+// writeSealedDiskBlobs shields priv and public into TpmSealedDiskPrivHdl and
+// TpmSealedDiskPubHdl (plus their mirror/parity indices), the common tail
+// shared by every seal path that writes those handles: SealDiskKey,
+// SealDiskKeyWithCounter, SealDiskKeyWithAuthorizedPolicy, sealShareToTpm,
+// and ImportSealedKey.
+func writeSealedDiskBlobs(rw io.ReadWriteCloser, priv, public []byte) error {
+	if err := writeShieldedNV(rw, TpmSealedDiskPrivHdl, TpmSealedDiskPrivMirrorHdl,
+		TpmSealedDiskPrivParityHdl, priv); err != nil {
+		return fmt.Errorf("shielding %v failed: %w", TpmSealedDiskPrivHdl, err)
+	}
+	if err := writeShieldedNV(rw, TpmSealedDiskPubHdl, TpmSealedDiskPubMirrorHdl,
+		TpmSealedDiskPubParityHdl, public); err != nil {
+		return fmt.Errorf("shielding %v failed: %w", TpmSealedDiskPubHdl, err)
+	}
+	return nil
+}
+
+// readSealedDiskBlobs reverses writeSealedDiskBlobs, the common head shared
+// by every unseal path that reads TpmSealedDiskPrivHdl/TpmSealedDiskPubHdl:
+// UnsealDiskKey, UnsealDiskKeyWithCounter, UnsealDiskKeyAuthorized, and
+// unsealShareFromTpm.
+func readSealedDiskBlobs(rw io.ReadWriteCloser) (priv, public []byte, err error) {
+	priv, err = readShieldedNV(rw, TpmSealedDiskPrivHdl, TpmSealedDiskPrivMirrorHdl,
+		TpmSealedDiskPrivParityHdl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unshielding %v failed: %w", TpmSealedDiskPrivHdl, err)
+	}
+	public, err = readShieldedNV(rw, TpmSealedDiskPubHdl, TpmSealedDiskPubMirrorHdl,
+		TpmSealedDiskPubParityHdl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unshielding %v failed: %w", TpmSealedDiskPubHdl, err)
+	}
+	return priv, public, nil
+}
@@ -17,6 +17,8 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"unsafe"
 
 	"github.com/google/go-tpm/tpm2"
@@ -58,22 +60,98 @@ const (
 	//MaxPasswdLength is the max length allowed for a TPM password
 	MaxPasswdLength = 7 //limit TPM password to this length
 
-	//TpmDiskKeyHdl is the handle for constructing disk encryption key
+	//TpmDiskKeyHdl is the handle for constructing disk encryption key; holds
+	//the first half of the legacy disk key, see TpmDiskKeyMirrorHdl
 	TpmDiskKeyHdl tpmutil.Handle = 0x1700000
 
+	//TpmDiskKeyMirrorHdl holds the legacy disk key's second half
+	TpmDiskKeyMirrorHdl tpmutil.Handle = 0x1710000
+
+	//TpmDiskKeyParityHdl holds XOR(first half, second half), so
+	//readDiskKey can reconstruct either half of the legacy disk key if its
+	//NV index is ever lost or corrupted
+	TpmDiskKeyParityHdl tpmutil.Handle = 0x1720000
+
 	//TpmDeviceCertHdl is the well known TPM NVIndex for device cert
 	TpmDeviceCertHdl tpmutil.Handle = 0x1500000
 
 	//TpmSealedDiskPrivHdl is the handle for constructing disk encryption key
 	TpmSealedDiskPrivHdl tpmutil.Handle = 0x1800000
 
+	//TpmSealedDiskPrivMirrorHdl holds the second half of the sealed disk
+	//key's priv blob, see TpmSealedDiskPrivParityHdl
+	TpmSealedDiskPrivMirrorHdl tpmutil.Handle = 0x1810000
+
+	//TpmSealedDiskPrivParityHdl holds XOR(first half, second half) of the
+	//sealed disk key's priv blob, so readShieldedNV can reconstruct either
+	//half if its NV index is ever lost or corrupted
+	TpmSealedDiskPrivParityHdl tpmutil.Handle = 0x1820000
+
 	//TpmSealedDiskPubHdl is the handle for constructing disk encryption key
 	TpmSealedDiskPubHdl tpmutil.Handle = 0x1900000
 
+	//TpmSealedDiskPubMirrorHdl holds the second half of the sealed disk
+	//key's public area, see TpmSealedDiskPubParityHdl
+	TpmSealedDiskPubMirrorHdl tpmutil.Handle = 0x1910000
+
+	//TpmSealedDiskPubParityHdl holds XOR(first half, second half) of the
+	//sealed disk key's public area, so readShieldedNV can reconstruct
+	//either half if its NV index is ever lost or corrupted
+	TpmSealedDiskPubParityHdl tpmutil.Handle = 0x1920000
+
+	//TpmRecoveryKeyPrivHdl is the handle for the recovery copy of the disk
+	//encryption key, sealed under a passphrase-derived policy rather than PCRs
+	TpmRecoveryKeyPrivHdl tpmutil.Handle = 0x1a00000
+
+	//TpmRecoveryKeyPubHdl is the handle for the recovery copy of the disk
+	//encryption key, sealed under a passphrase-derived policy rather than PCRs
+	TpmRecoveryKeyPubHdl tpmutil.Handle = 0x1b00000
+
+	//TpmRecoveryPasswdFileName is the file that holds the enrolled recovery
+	//passphrase, used to unseal TpmRecoveryKeyPrivHdl/TpmRecoveryKeyPubHdl
+	//when the PCR policy on TpmSealedDiskPrivHdl/TpmSealedDiskPubHdl no
+	//longer matches
+	TpmRecoveryPasswdFileName = types.IdentityDirname + "/tpm_recovery_passwd"
+
+	//TpmSealedBlobKeyPrivHdl is the handle for the content key SealBlob seals
+	TpmSealedBlobKeyPrivHdl tpmutil.Handle = 0x1c00000
+
+	//TpmSealedBlobKeyPubHdl is the handle for the content key SealBlob seals
+	TpmSealedBlobKeyPubHdl tpmutil.Handle = 0x1d00000
+
+	//TpmSealedBlobCipherFileName holds the AES-256-GCM ciphertext SealBlob
+	//produced; too large to fit in a TPM sealed data object on most devices
+	TpmSealedBlobCipherFileName = types.PersistStatusDir + "/tpm_sealed_blob"
+
+	//TpmVaultPolicyCounterHdl is the NV counter SealDiskKeyWithCounter/
+	//UnsealDiskKeyWithCounter bind the vault seal policy to, for anti-rollback
+	TpmVaultPolicyCounterHdl tpmutil.Handle = 0x1880000
+
+	//TpmVaultPolicyCounterStampFileName holds the counter value stamped into
+	//the sealed disk key's policy at seal time
+	TpmVaultPolicyCounterStampFileName = types.PersistStatusDir + "/tpm_vault_policy_counter"
+
+	//TpmPolicyAuthKeyPubHdl is the handle the EVE controller's PCR-approval
+	//signing key's public area is persisted under, so it survives reboots;
+	//SealDiskKeyWithAuthorizedPolicy's TPM2_PolicyAuthorize policy names this
+	//key, letting a controller-signed PCR approval stand in for a fixed PCR
+	//policy
+	TpmPolicyAuthKeyPubHdl tpmutil.Handle = 0x1e00000
+
+	//TpmAuthorizedPCRSetsFileName holds the controller-signed list of
+	//pre-approved PCR sets AddAuthorizedPCRSet appends to and
+	//UnsealDiskKeyAuthorized consults at unseal time
+	TpmAuthorizedPCRSetsFileName = types.PersistStatusDir + "/tpm_authorized_pcr_sets"
+
 	//EmptyPassword is an empty string
 	EmptyPassword  = ""
 	vaultKeyLength = 32 //Bytes
 
+	// blobContentKeyLength is the size of the AES-256 content key SealBlob
+	// generates to encrypt the caller's data before sealing the content key
+	// itself (and not the, possibly much larger, data) into the TPM.
+	blobContentKeyLength = 32 //Bytes
+
 	// TpmSavedDiskSealingPcrs is the file that holds a copy of PCR values
 	// at the time of generating and sealing the disk key into the TPM.
 	TpmSavedDiskSealingPcrs = types.PersistStatusDir + "/sealingpcrs"
@@ -113,6 +191,18 @@ const (
 	PCRBank256StatusNotSupported
 )
 
+// pcrBankStatus caches PCRBankSupported's result per algorithm, the
+// generalization of pcrBank256Status to every bank a platform might
+// enable (SHA1, SHA256, SHA384, SHA512).
+var pcrBankStatus = make(map[tpm2.Algorithm]PCRBank256Status)
+
+// sealingBankPriority lists PCR banks in the order SelectSealingBank
+// prefers them, strongest first: some server-class TPMs disable SHA-1 and
+// even SHA-256 outright in favor of SHA-384 (CNSA requires at least
+// SHA-384), so picking the strongest enabled bank rather than assuming
+// SHA-256 keeps sealing working on that hardware.
+var sealingBankPriority = []tpm2.Algorithm{tpm2.AlgSHA512, tpm2.AlgSHA384, tpm2.AlgSHA256}
+
 var (
 	//EcdhKeyFile is the location of the ecdh private key
 	//on devices without a TPM. It is not a constant due to test usage
@@ -211,6 +301,18 @@ func ReadOwnerCrdl() (string, error) {
 
 // TpmSign is used by external packages to get a digest signed by
 // device key in TPM
+//
+// XXX the digest and the returned signature still cross the bus to/from
+// the TPM unencrypted: tpm2.Sign doesn't take a session argument in this
+// package's go-tpm version, so there's nowhere to plug in a session at all,
+// salted or not. Note that even PolicyPCRSession/PolicyAuthValueSession's
+// salted Session doesn't get parameter encryption for the seal/unseal it
+// authorizes -- salting only protects the session's own establishment
+// (its HMAC key) against a bus interposer, it doesn't mark any command's
+// parameters for TPM2 session-based encryption, which needs the session to
+// carry an explicit decrypt/encrypt attribute this package's go-tpm version
+// has no way to set. Revisit both gaps once the vendored go-tpm grows the
+// "direct" session API.
 func TpmSign(digest []byte) (*big.Int, *big.Int, error) {
 	rw, err := tpm2.OpenTPM(TpmDevicePath)
 	if err != nil {
@@ -248,6 +350,10 @@ func IsTpmEnabled() bool {
 }
 
 // GetRandom returns a random []byte of requested length
+//
+// XXX same limitation as TpmSign: tpm2.GetRandom takes no session
+// argument here, so the returned bytes (which end up as the vault key
+// itself on a fresh install, see FetchVaultKey) are not wire-encrypted.
 func GetRandom(numBytes uint16) ([]byte, error) {
 	rw, err := tpm2.OpenTPM(TpmDevicePath)
 	if err != nil {
@@ -436,6 +542,28 @@ func FetchVaultKey(log *base.LogObject) ([]byte, error) {
 	return key, nil
 }
 
+// xorBytes XORs a and b byte by byte over len(a); b must be at least as
+// long as a. The 32-byte legacy disk key and writeShieldedNV's even-padded
+// buffer both split into equal-length halves, so every caller meets that.
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// writeDiskKey splits key across TpmDiskKeyHdl and TpmDiskKeyMirrorHdl and
+// writes their XOR to TpmDiskKeyParityHdl, so readDiskKey can reconstruct
+// either half if one NV index is later lost or corrupted -- the NV
+// equivalent of the Reed-Solomon shielding writeShielded/readShielded give
+// the on-disk PCR snapshot, scaled down since a 32-byte key is too small to
+// usefully shard into 128-byte Reed-Solomon pieces.
+//
+// writeDiskKey, like readDiskKey below, still uses NVWrite's plain
+// HandleOwner/EmptyPassword auth rather than a Session -- NVWrite has no
+// session argument to carry parameter encryption on in this go-tpm
+// version, see the XXX notes on TpmSign/GetRandom.
 func writeDiskKey(key []byte) error {
 	rw, err := tpm2.OpenTPM(TpmDevicePath)
 	if err != nil {
@@ -443,27 +571,39 @@ func writeDiskKey(key []byte) error {
 	}
 	defer rw.Close()
 
-	//not an error if it fails
-	tpm2.NVUndefineSpace(rw, EmptyPassword,
-		tpm2.HandleOwner, TpmDiskKeyHdl)
-
-	// Define space in NV storage and clean up afterwards or subsequent runs will fail.
-	if err := tpm2.NVDefineSpace(rw,
-		tpm2.HandleOwner,
-		TpmDiskKeyHdl,
-		EmptyPassword,
-		EmptyPassword,
-		nil,
-		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
-		uint16(len(key)),
-	); err != nil {
-		return fmt.Errorf("NVDefineSpace failed: %v", err)
-	}
+	half := (len(key) + 1) / 2
+	first, second := key[:half], key[half:]
+	parity := xorBytes(first, second)
+
+	for _, nv := range []struct {
+		hdl  tpmutil.Handle
+		data []byte
+	}{
+		{TpmDiskKeyHdl, first},
+		{TpmDiskKeyMirrorHdl, second},
+		{TpmDiskKeyParityHdl, parity},
+	} {
+		//not an error if it fails
+		tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, nv.hdl)
+
+		// Define space in NV storage and clean up afterwards or subsequent runs will fail.
+		if err := tpm2.NVDefineSpace(rw,
+			tpm2.HandleOwner,
+			nv.hdl,
+			EmptyPassword,
+			EmptyPassword,
+			nil,
+			tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
+			uint16(len(nv.data)),
+		); err != nil {
+			return fmt.Errorf("NVDefineSpace %v failed: %v", nv.hdl, err)
+		}
 
-	// Write the data
-	if err := tpm2.NVWrite(rw, tpm2.HandleOwner, TpmDiskKeyHdl,
-		EmptyPassword, key, 0); err != nil {
-		return fmt.Errorf("NVWrite failed: %v", err)
+		// Write the data
+		if err := tpm2.NVWrite(rw, tpm2.HandleOwner, nv.hdl,
+			EmptyPassword, nv.data, 0); err != nil {
+			return fmt.Errorf("NVWrite %v failed: %v", nv.hdl, err)
+		}
 	}
 	return nil
 }
@@ -475,13 +615,31 @@ func readDiskKey() ([]byte, error) {
 	}
 	defer rw.Close()
 
-	// Read all of the data with NVReadEx
-	keyBytes, err := tpm2.NVReadEx(rw, TpmDiskKeyHdl,
-		tpm2.HandleOwner, EmptyPassword, 0)
-	if err != nil {
-		return nil, fmt.Errorf("NVReadEx failed: %v", err)
+	first, firstErr := tpm2.NVReadEx(rw, TpmDiskKeyHdl, tpm2.HandleOwner, EmptyPassword, 0)
+	second, secondErr := tpm2.NVReadEx(rw, TpmDiskKeyMirrorHdl, tpm2.HandleOwner, EmptyPassword, 0)
+	if firstErr == nil && secondErr == nil {
+		return append(append([]byte{}, first...), second...), nil
 	}
-	return keyBytes, nil
+
+	parity, parityErr := tpm2.NVReadEx(rw, TpmDiskKeyParityHdl, tpm2.HandleOwner, EmptyPassword, 0)
+	if parityErr != nil {
+		if firstErr != nil {
+			return nil, fmt.Errorf("NVReadEx %v failed: %v", TpmDiskKeyHdl, firstErr)
+		}
+		return nil, fmt.Errorf("NVReadEx %v failed: %v", TpmDiskKeyMirrorHdl, secondErr)
+	}
+
+	switch {
+	case firstErr != nil && secondErr == nil:
+		fmt.Fprintf(os.Stderr, "%v: reconstructed from parity, medium may be failing and should be replaced\n", TpmDiskKeyHdl)
+		first = xorBytes(parity, second)
+	case secondErr != nil && firstErr == nil:
+		fmt.Fprintf(os.Stderr, "%v: reconstructed from parity, medium may be failing and should be replaced\n", TpmDiskKeyMirrorHdl)
+		second = xorBytes(parity, first)
+	default:
+		return nil, fmt.Errorf("NVReadEx failed: %v, %v", firstErr, secondErr)
+	}
+	return append(append([]byte{}, first...), second...), nil
 }
 
 // FetchSealedVaultKey fetches Vault key sealed into TPM2.0
@@ -567,11 +725,43 @@ func FetchSealedVaultKey(log *base.LogObject) ([]byte, error) {
 	if err == nil {
 		// be more verbose, lets celebrate
 		log.Noticef("successfully unsealed the disk key from TPM")
+		return key, nil
+	}
+
+	// PCR policy failed, most likely because of a firmware/bootloader
+	// update that moved one of the sealing PCRs out from under us. Before
+	// giving up and handing back the measurement-log diagnostic above,
+	// try the recovery passphrase path, which doesn't depend on PCR state.
+	if recoveryKey, recoveryErr := tryRecoveryFallback(log); recoveryErr == nil {
+		return recoveryKey, nil
 	}
 
 	return key, err
 }
 
+// tryRecoveryFallback attempts to unseal the vault key using the enrolled
+// recovery passphrase, for use when UnsealDiskKey's PCR policy fails.
+// It returns an error, rather than logging one, whenever there is no
+// recovery key enrolled at all, since that is the common case and not
+// worth alarming about.
+func tryRecoveryFallback(log *base.LogObject) ([]byte, error) {
+	if !isRecoveryKeyPresent() {
+		return nil, fmt.Errorf("no recovery key enrolled")
+	}
+	passphrase, err := readRecoveryPasswd()
+	if err != nil {
+		return nil, fmt.Errorf("reading recovery passphrase failed: %w", err)
+	}
+	log.Noticef("unsealing via PCR policy failed, falling back to recovery key")
+	key, err := UnsealWithRecoveryKey(passphrase)
+	if err != nil {
+		log.Errorf("recovery key fallback also failed: %v", err)
+		return nil, err
+	}
+	log.Noticef("successfully unsealed the disk key using the recovery passphrase")
+	return key, nil
+}
+
 // SealDiskKey seals key into TPM2.0, with provided PCRs
 func SealDiskKey(key []byte, pcrSel tpm2.PCRSelection) error {
 	rw, err := tpm2.OpenTPM(TpmDevicePath)
@@ -612,41 +802,10 @@ func SealDiskKey(key []byte, pcrSel tpm2.PCRSelection) error {
 		return fmt.Errorf("sealing the disk key into TPM failed: %w", err)
 	}
 
-	// Define space in NV storage and clean up afterwards or subsequent runs will fail.
-	if err := tpm2.NVDefineSpace(rw,
-		tpm2.HandleOwner,
-		TpmSealedDiskPrivHdl,
-		EmptyPassword,
-		EmptyPassword,
-		nil,
-		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
-		uint16(len(priv)),
-	); err != nil {
-		return fmt.Errorf("NVDefineSpace %v failed: %v", TpmSealedDiskPrivHdl, err)
-	}
-
-	// Write the private data
-	if err := tpm2.NVWrite(rw, tpm2.HandleOwner, TpmSealedDiskPrivHdl,
-		EmptyPassword, priv, 0); err != nil {
-		return fmt.Errorf("NVWrite %v failed: %v", TpmSealedDiskPrivHdl, err)
-	}
-
-	// Define space in NV storage
-	if err := tpm2.NVDefineSpace(rw,
-		tpm2.HandleOwner,
-		TpmSealedDiskPubHdl,
-		EmptyPassword,
-		EmptyPassword,
-		nil,
-		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
-		uint16(len(public)),
-	); err != nil {
-		return fmt.Errorf("NVDefineSpace %v failed: %v", TpmSealedDiskPubHdl, err)
-	}
-	// Write the public data
-	if err := tpm2.NVWrite(rw, tpm2.HandleOwner, TpmSealedDiskPubHdl,
-		EmptyPassword, public, 0); err != nil {
-		return fmt.Errorf("NVWrite %v failed: %v", TpmSealedDiskPubHdl, err)
+	// Shield priv/public across their NV indices plus mirror/parity, so the
+	// vault survives one of those indices becoming unreadable.
+	if err := writeSealedDiskBlobs(rw, priv, public); err != nil {
+		return err
 	}
 
 	// save a snapshot of current PCR values
@@ -702,17 +861,9 @@ func UnsealDiskKey(pcrSel tpm2.PCRSelection) ([]byte, error) {
 	}
 	defer rw.Close()
 
-	// Read all of the data with NVReadEx
-	priv, err := tpm2.NVReadEx(rw, TpmSealedDiskPrivHdl,
-		tpm2.HandleOwner, EmptyPassword, 0)
-	if err != nil {
-		return nil, fmt.Errorf("NVReadEx %v failed: %v", TpmSealedDiskPrivHdl, err)
-	}
-	// Read all of the data with NVReadEx
-	pub, err := tpm2.NVReadEx(rw, TpmSealedDiskPubHdl,
-		tpm2.HandleOwner, EmptyPassword, 0)
+	priv, pub, err := readSealedDiskBlobs(rw)
 	if err != nil {
-		return nil, fmt.Errorf("NVReadEx %v failed: %v", TpmSealedDiskPubHdl, err)
+		return nil, err
 	}
 
 	sealedObjHandle, _, err := tpm2.Load(rw, TpmSRKHdl, "", pub, priv)
@@ -744,24 +895,36 @@ func UnsealDiskKey(pcrSel tpm2.PCRSelection) ([]byte, error) {
 			return nil, fmt.Errorf("UnsealWithSession failed: %w, %s, finding mismatching PCR failed: %v", err, evtLogStat, errPcrMiss)
 		}
 
-		return nil, fmt.Errorf("UnsealWithSession failed: %w, %s, possibly mismatching PCR indexes: %v", err, evtLogStat, mismatch)
+		// Best-effort: point at the exact event(s) that changed between the
+		// seal-time and this failed-unseal event log, not just the PCR index.
+		var diagnosis string
+		if events, errEvents := findMismatchingEvents(); errEvents == nil {
+			diagnosis = fmt.Sprintf(", mismatching events: %+v", events)
+		}
+
+		// Best-effort: for each mismatching PCR, pin down the single event in
+		// this boot's log responsible for it, rather than just diffing two
+		// logs against each other.
+		if causes, errCauses := DiagnoseSealMismatch(TpmSavedDiskSealingPcrs,
+			fmt.Sprintf(TpmEvtLogSavePattern, MeasurementLogUnsealFail, 0)); errCauses == nil {
+			diagnosis += fmt.Sprintf(", root-cause events: %+v", causes)
+		}
+
+		return nil, fmt.Errorf("UnsealWithSession failed: %w, %s, possibly mismatching PCR indexes: %v%s",
+			err, evtLogStat, mismatch, diagnosis)
 	}
 	return key, nil
 }
 
-// PolicyPCRSession prepares TPM2 Auth Policy session, with PCR as the policy
+// PolicyPCRSession prepares TPM2 Auth Policy session, with PCR as the policy.
+// The session is salted against TpmEKHdl when the EK is available, so a bus
+// interposer can no longer transparently relay or replay the PCR policy
+// assertion; it falls back to the previous unsalted, unencrypted session
+// when there is no usable EK (e.g. no TPM, or an unprovisioned one).
 func PolicyPCRSession(rw io.ReadWriteCloser, pcrSel tpm2.PCRSelection) (tpmutil.Handle, []byte, error) {
-	session, _, err := tpm2.StartAuthSession(
-		rw,
-		/*tpmkey=*/ tpm2.HandleNull,
-		/*bindkey=*/ tpm2.HandleNull,
-		/*nonceCaller=*/ make([]byte, 16),
-		/*encryptedSalt=*/ nil,
-		/*sessionType=*/ tpm2.SessionPolicy,
-		/*symmetric=*/ tpm2.AlgNull,
-		/*authHash=*/ tpm2.AlgSHA256)
+	session, err := startSaltedPolicySession(rw)
 	if err != nil {
-		return tpm2.HandleNull, nil, fmt.Errorf("StartAuthSession failed: %v", err)
+		return tpm2.HandleNull, nil, err
 	}
 	defer func() {
 		if session != tpm2.HandleNull && err != nil {
@@ -780,6 +943,187 @@ func PolicyPCRSession(rw io.ReadWriteCloser, pcrSel tpm2.PCRSelection) (tpmutil.
 	return session, policy, nil
 }
 
+// PolicyAuthValueSession prepares a TPM2 Auth Policy session whose policy is
+// satisfied by presenting the sealed object's own auth value (here, the
+// recovery passphrase), rather than a PCR state like PolicyPCRSession. This
+// is what makes the recovery path usable across the PCR changes a firmware
+// or bootloader update would otherwise make: the policy just doesn't involve
+// PCRs at all.
+func PolicyAuthValueSession(rw io.ReadWriteCloser) (tpmutil.Handle, []byte, error) {
+	session, err := startSaltedPolicySession(rw)
+	if err != nil {
+		return tpm2.HandleNull, nil, err
+	}
+	defer func() {
+		if session != tpm2.HandleNull && err != nil {
+			tpm2.FlushContext(rw, session)
+		}
+	}()
+
+	if err = tpm2.PolicyAuthValue(rw, session); err != nil {
+		return session, nil, fmt.Errorf("PolicyAuthValue failed: %v", err)
+	}
+
+	policy, err := tpm2.PolicyGetDigest(rw, session)
+	if err != nil {
+		return session, nil, fmt.Errorf("PolicyGetDigest failed: %w", err)
+	}
+	return session, policy, nil
+}
+
+// SealRecoveryKey seals key into TPM2.0 as the recovery copy, under a
+// TPM2_PolicyAuthValue policy keyed on passphrase instead of SealDiskKey's
+// PCR policy. Vault callers fall back to UnsealWithRecoveryKey when
+// UnsealDiskKey fails, typically with RCPolicyFail after a PCR-affecting
+// update.
+func SealRecoveryKey(key []byte, passphrase string) error {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+
+	tpm2.NVUndefineSpace(rw, EmptyPassword,
+		tpm2.HandleOwner, TpmRecoveryKeyPubHdl)
+
+	tpm2.NVUndefineSpace(rw, EmptyPassword,
+		tpm2.HandleOwner, TpmRecoveryKeyPrivHdl)
+
+	session, policy, err := PolicyAuthValueSession(rw)
+	if err != nil {
+		return fmt.Errorf("PolicyAuthValueSession failed: %v", err)
+	}
+
+	//Don't need the handle, we need only the policy for sealing
+	if err := tpm2.FlushContext(rw, session); err != nil {
+		return fmt.Errorf("flushing session handle %v failed: %v", session, err)
+	}
+
+	priv, public, err := tpm2.Seal(rw, TpmSRKHdl, EmptyPassword, passphrase, policy, key)
+	if err != nil {
+		return fmt.Errorf("sealing the recovery key into TPM failed: %w", err)
+	}
+
+	// Define space in NV storage and clean up afterwards or subsequent runs will fail.
+	if err := tpm2.NVDefineSpace(rw,
+		tpm2.HandleOwner,
+		TpmRecoveryKeyPrivHdl,
+		EmptyPassword,
+		EmptyPassword,
+		nil,
+		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
+		uint16(len(priv)),
+	); err != nil {
+		return fmt.Errorf("NVDefineSpace %v failed: %v", TpmRecoveryKeyPrivHdl, err)
+	}
+
+	// Write the private data
+	if err := tpm2.NVWrite(rw, tpm2.HandleOwner, TpmRecoveryKeyPrivHdl,
+		EmptyPassword, priv, 0); err != nil {
+		return fmt.Errorf("NVWrite %v failed: %v", TpmRecoveryKeyPrivHdl, err)
+	}
+
+	// Define space in NV storage
+	if err := tpm2.NVDefineSpace(rw,
+		tpm2.HandleOwner,
+		TpmRecoveryKeyPubHdl,
+		EmptyPassword,
+		EmptyPassword,
+		nil,
+		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead,
+		uint16(len(public)),
+	); err != nil {
+		return fmt.Errorf("NVDefineSpace %v failed: %v", TpmRecoveryKeyPubHdl, err)
+	}
+	// Write the public data
+	if err := tpm2.NVWrite(rw, tpm2.HandleOwner, TpmRecoveryKeyPubHdl,
+		EmptyPassword, public, 0); err != nil {
+		return fmt.Errorf("NVWrite %v failed: %v", TpmRecoveryKeyPubHdl, err)
+	}
+
+	return nil
+}
+
+// UnsealWithRecoveryKey unseals the vault key sealed by SealRecoveryKey,
+// using passphrase to satisfy the object's PolicyAuthValue policy.
+func UnsealWithRecoveryKey(passphrase string) ([]byte, error) {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rw.Close()
+
+	// Read all of the data with NVReadEx
+	priv, err := tpm2.NVReadEx(rw, TpmRecoveryKeyPrivHdl,
+		tpm2.HandleOwner, EmptyPassword, 0)
+	if err != nil {
+		return nil, fmt.Errorf("NVReadEx %v failed: %v", TpmRecoveryKeyPrivHdl, err)
+	}
+	// Read all of the data with NVReadEx
+	pub, err := tpm2.NVReadEx(rw, TpmRecoveryKeyPubHdl,
+		tpm2.HandleOwner, EmptyPassword, 0)
+	if err != nil {
+		return nil, fmt.Errorf("NVReadEx %v failed: %v", TpmRecoveryKeyPubHdl, err)
+	}
+
+	sealedObjHandle, _, err := tpm2.Load(rw, TpmSRKHdl, "", pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("loading the recovery key into TPM failed: %w", err)
+	}
+	defer tpm2.FlushContext(rw, sealedObjHandle)
+
+	session, _, err := PolicyAuthValueSession(rw)
+	if err != nil {
+		return nil, fmt.Errorf("PolicyAuthValueSession failed: %v", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	key, err := tpm2.UnsealWithSession(rw, session, sealedObjHandle, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("UnsealWithSession failed: %w", err)
+	}
+	return key, nil
+}
+
+// EnrollRecoveryKey (re)seals key under passphrase as the recovery copy of
+// the vault key, replacing any previously enrolled recovery key and
+// persisting passphrase to TpmRecoveryPasswdFileName so FetchSealedVaultKey
+// can use it automatically. This is the operation behind the TPM management
+// CLI's "enroll"/"rotate recovery key" subcommand -- an operator runs it
+// once to enroll a recovery passphrase, and again later to rotate it.
+func EnrollRecoveryKey(key []byte, passphrase string) error {
+	if passphrase == "" {
+		return fmt.Errorf("EnrollRecoveryKey: passphrase must not be empty")
+	}
+	if err := SealRecoveryKey(key, passphrase); err != nil {
+		return fmt.Errorf("EnrollRecoveryKey: %w", err)
+	}
+	if err := fileutils.WriteRename(TpmRecoveryPasswdFileName, []byte(passphrase)); err != nil {
+		return fmt.Errorf("EnrollRecoveryKey: persisting recovery passphrase failed: %w", err)
+	}
+	return nil
+}
+
+func isRecoveryKeyPresent() bool {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return false
+	}
+	defer rw.Close()
+
+	_, err = tpm2.NVReadEx(rw, TpmRecoveryKeyPrivHdl,
+		tpm2.HandleOwner, EmptyPassword, 0)
+	return err == nil
+}
+
+func readRecoveryPasswd() (string, error) {
+	b, err := os.ReadFile(TpmRecoveryPasswdFileName)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 // CompareLegacyandSealedKey compares legacy and sealed keys
 // to record if we are using a new key for sealed vault
 func CompareLegacyandSealedKey() SealedKeyType {
@@ -793,10 +1137,25 @@ func CompareLegacyandSealedKey() SealedKeyType {
 	}
 	unsealedKey, err := UnsealDiskKey(DiskKeySealingPCRs)
 	if err != nil {
-		//key is present but can't unseal it
-		//but legacy key is present
-		//at this point, vault is probably locked up
-		return SealedKeyTypeUnknown
+		//key is present but PolicyPCRSession's fixed PCR digest no longer
+		//matches, e.g. after a legitimate firmware/bootloader/kernel update;
+		//see if a controller-pushed PCR approval unseals it before giving up
+		if authKey, authErr := UnsealDiskKeyAuthorized(DiskKeySealingPCRs); authErr == nil {
+			unsealedKey = authKey
+		} else if k, _, qErr := readQuorumMetadata(); qErr == nil {
+			//not sealed monolithically at all, but as a SealDiskKeyThreshold
+			//quorum; try reconstructing from whichever mapped TPMs still
+			//unseal their share
+			if quorumKey, quorumErr := UnsealDiskKeyThreshold(k); quorumErr == nil {
+				unsealedKey = quorumKey
+			} else {
+				return SealedKeyTypeUnknown
+			}
+		} else {
+			//legacy key is present, but can't unseal the sealed key by any
+			//means; at this point, vault is probably locked up
+			return SealedKeyTypeUnknown
+		}
 	}
 	if bytes.Equal(legacyKey, unsealedKey) {
 		//Same, return SealedKeyTypeReused
@@ -805,20 +1164,42 @@ func CompareLegacyandSealedKey() SealedKeyType {
 	return SealedKeyTypeNew
 }
 
-// WipeOutStaleSealedKeyIfAny checks and deletes
-// sealed vault key
+// WipeOutStaleSealedKeyIfAny checks and deletes the sealed vault key (or, if
+// sealed via SealDiskKeyThreshold, every TPM's share of it) from every TPM
+// getMappedTpmsPath enumerates, not just the primary one.
 func WipeOutStaleSealedKeyIfAny() error {
-	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	paths, err := getMappedTpmsPath()
 	if err != nil {
-		return err
+		return fmt.Errorf("getMappedTpmsPath failed: %w", err)
 	}
-	defer rw.Close()
 
-	tpm2.NVUndefineSpace(rw, EmptyPassword,
-		tpm2.HandleOwner, TpmSealedDiskPubHdl)
+	for _, path := range paths {
+		devicePath, err := tpmDevicePathForSysfsPath(path)
+		if err != nil {
+			// can't tell which /dev node this sysfs entry maps to; nothing
+			// to wipe there
+			continue
+		}
+		rw, err := tpm2.OpenTPM(devicePath)
+		if err != nil {
+			// that TPM isn't reachable; nothing to wipe there
+			continue
+		}
 
-	tpm2.NVUndefineSpace(rw, EmptyPassword,
-		tpm2.HandleOwner, TpmSealedDiskPrivHdl)
+		tpm2.NVUndefineSpace(rw, EmptyPassword,
+			tpm2.HandleOwner, TpmSealedDiskPubHdl)
+
+		tpm2.NVUndefineSpace(rw, EmptyPassword,
+			tpm2.HandleOwner, TpmSealedDiskPrivHdl)
+
+		// readShieldedNV would otherwise rebuild the blobs from these
+		for _, hdl := range []tpmutil.Handle{TpmSealedDiskPubMirrorHdl, TpmSealedDiskPubParityHdl,
+			TpmSealedDiskPrivMirrorHdl, TpmSealedDiskPrivParityHdl} {
+			tpm2.NVUndefineSpace(rw, EmptyPassword, tpm2.HandleOwner, hdl)
+		}
+
+		rw.Close()
+	}
 
 	return nil
 }
@@ -826,18 +1207,25 @@ func WipeOutStaleSealedKeyIfAny() error {
 // PCRBankSHA256Enabled checks if SHA256 PCR Bank is
 // enabled
 func PCRBankSHA256Enabled() bool {
-	//Check if we have cached it already, if not fetch, store and return
-	if pcrBank256Status == PCRBank256StatusUnknown {
-		if pcrBankSHA256EnabledHelper() {
-			pcrBank256Status = PCRBank256StatusSupported
-		} else {
-			pcrBank256Status = PCRBank256StatusNotSupported
-		}
+	return PCRBankSupported(tpm2.AlgSHA256)
+}
+
+// PCRBankSupported reports whether alg's PCR bank is enabled on this
+// platform, caching the result per algorithm the same way
+// PCRBankSHA256Enabled always has for SHA256.
+func PCRBankSupported(alg tpm2.Algorithm) bool {
+	if status, ok := pcrBankStatus[alg]; ok && status != PCRBank256StatusUnknown {
+		return status == PCRBank256StatusSupported
 	}
-	return pcrBank256Status == PCRBank256StatusSupported
+	if pcrBankSupportedHelper(alg) {
+		pcrBankStatus[alg] = PCRBank256StatusSupported
+	} else {
+		pcrBankStatus[alg] = PCRBank256StatusNotSupported
+	}
+	return pcrBankStatus[alg] == PCRBank256StatusSupported
 }
 
-func pcrBankSHA256EnabledHelper() bool {
+func pcrBankSupportedHelper(alg tpm2.Algorithm) bool {
 	//Fetch, cache and return
 	if !IsTpmEnabled() {
 		return false
@@ -849,11 +1237,45 @@ func pcrBankSHA256EnabledHelper() bool {
 	}
 	defer rw.Close()
 
-	//test is by reading PCR index 0 from SHA256 bank
-	_, err = tpm2.ReadPCR(rw, 0, tpm2.AlgSHA256)
+	//test is by reading PCR index 0 from the requested bank
+	_, err = tpm2.ReadPCR(rw, 0, alg)
 	return err == nil
 }
 
+// SelectSealingBank queries TPM2_GetCapability(TPM_CAP_PCRS) for the set of
+// PCR banks this platform currently has allocated and updates
+// DiskKeySealingPCRs.Hash to the strongest one enabled, per
+// sealingBankPriority, so sealing doesn't hard-assume SHA256 is available.
+func SelectSealingBank() (tpm2.Algorithm, error) {
+	rw, err := tpm2.OpenTPM(TpmDevicePath)
+	if err != nil {
+		return tpm2.AlgNull, err
+	}
+	defer rw.Close()
+
+	caps, _, err := tpm2.GetCapability(rw, tpm2.CapabilityPCRs, 1, 0)
+	if err != nil {
+		return tpm2.AlgNull, fmt.Errorf("GetCapability(TPM_CAP_PCRS) failed: %w", err)
+	}
+
+	enabled := make(map[tpm2.Algorithm]bool)
+	for _, c := range caps {
+		sel, ok := c.(tpm2.PCRSelection)
+		if !ok || len(sel.PCRs) == 0 {
+			continue
+		}
+		enabled[sel.Hash] = true
+	}
+
+	for _, alg := range sealingBankPriority {
+		if enabled[alg] {
+			DiskKeySealingPCRs.Hash = alg
+			return alg, nil
+		}
+	}
+	return tpm2.AlgNull, fmt.Errorf("no supported PCR bank found among %v", sealingBankPriority)
+}
+
 func getMappedTpmsPath() ([]string, error) {
 	paths, err := filepath.Glob(syfsTpmDir)
 	if err != nil {
@@ -865,6 +1287,25 @@ func getMappedTpmsPath() ([]string, error) {
 	return paths, nil
 }
 
+// tpmDevicePathForSysfsPath returns the /dev/tpmrmN device node for the TPM
+// mapped at sysfsPath, one of getMappedTpmsPath's entries (e.g.
+// ".../security/tpm1"). N is parsed out of sysfsPath's own basename rather
+// than assumed from the entry's position in getMappedTpmsPath's result:
+// filepath.Glob doesn't guarantee every /sys entry up to the count is
+// present, so a platform missing tpm0 but mapping tpm1 would otherwise have
+// its first (and only) entry misattributed to /dev/tpmrm0.
+func tpmDevicePathForSysfsPath(sysfsPath string) (string, error) {
+	name := filepath.Base(sysfsPath)
+	numStr := strings.TrimPrefix(name, "tpm")
+	if numStr == name {
+		return "", fmt.Errorf("unexpected sysfs TPM entry name %q", name)
+	}
+	if _, err := strconv.Atoi(numStr); err != nil {
+		return "", fmt.Errorf("unexpected sysfs TPM entry name %q: %w", name, err)
+	}
+	return fmt.Sprintf("/dev/tpmrm%s", numStr), nil
+}
+
 func countMappedTpms() (int, error) {
 	paths, err := getMappedTpmsPath()
 	if err != nil {
@@ -972,6 +1413,16 @@ func copyMeasurementLog(dstPath string) error {
 	return nil
 }
 
+// sealedPCRSnapshot is the gob-encoded content of TpmSavedDiskSealingPcrs:
+// the PCR values read at seal time, tagged with the bank they were read
+// from, so findMismatchingPCRs can tell a genuine PCR mismatch apart from
+// having been sealed under a bank the platform no longer selects (e.g.
+// after a SelectSealingBank upgrade from SHA256 to SHA384).
+type sealedPCRSnapshot struct {
+	Hash tpm2.Algorithm
+	PCRs map[int][]byte
+}
+
 func saveDiskKeySealingPCRs(pcrsFile string) error {
 	trw, err := tpm2.OpenTPM(TpmDevicePath)
 	if err != nil {
@@ -986,27 +1437,39 @@ func saveDiskKeySealingPCRs(pcrsFile string) error {
 
 	buff := new(bytes.Buffer)
 	e := gob.NewEncoder(buff)
-	err = e.Encode(readPCRs)
+	err = e.Encode(sealedPCRSnapshot{Hash: DiskKeySealingPCRs.Hash, PCRs: readPCRs})
 	if err != nil {
 		return err
 	}
 
-	return fileutils.WriteRename(pcrsFile, buff.Bytes())
+	// Reed-Solomon shielded rather than a plain WriteRename: a bit flip in
+	// this file on the persistent partition would otherwise strand
+	// UnsealDiskKey's diagnostics (and findMismatchingPCRs) with no way to
+	// tell a real PCR mismatch from a corrupted snapshot.
+	return writeShielded(pcrsFile, buff.Bytes())
 }
 
 func findMismatchingPCRs(savedPCRsFile string) ([]int, error) {
-	frw, err := os.Open(savedPCRsFile)
+	raw, repaired, err := readShielded(savedPCRsFile)
 	if err != nil {
 		return nil, err
 	}
-	defer frw.Close()
+	if repaired {
+		fmt.Fprintf(os.Stderr, "%s: reconstructed from Reed-Solomon parity, "+
+			"medium may be failing and should be replaced\n", savedPCRsFile)
+	}
 
-	var savedPCRs map[int][]byte
-	d := gob.NewDecoder(frw)
-	err = d.Decode(&savedPCRs)
+	var snapshot sealedPCRSnapshot
+	d := gob.NewDecoder(bytes.NewReader(raw))
+	err = d.Decode(&snapshot)
 	if err != nil {
 		return nil, err
 	}
+	if snapshot.Hash != DiskKeySealingPCRs.Hash {
+		return nil, fmt.Errorf("saved PCR snapshot bank %v does not match the live selected bank %v",
+			snapshot.Hash, DiskKeySealingPCRs.Hash)
+	}
+	savedPCRs := snapshot.PCRs
 
 	readPCRs, err := readDiskKeySealingPCRs()
 	if err != nil {